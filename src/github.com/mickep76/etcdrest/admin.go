@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/mickep76/etcdrest/config"
+	"github.com/mickep76/etcdrest/etcd"
+	"github.com/mickep76/etcdrest/server"
+)
+
+// admin changes the routes of a running server, see server.Admin. It holds the
+// config the server is running with, the lock is held while it's replaced.
+type admin struct {
+	sync.Mutex
+	cfg *config.Config
+	sc  server.Config
+	es  etcd.Session
+	// unsaved is set when routes have changed without being saved to the config file.
+	unsaved bool
+}
+
+// apply replace the config of the running server, the running config is kept if
+// the new config has a problem. The caller holds the lock.
+func (a *admin) apply(next *config.Config) error {
+	nsc, err := newServer(next, a.es, a)
+	if err != nil {
+		return err
+	}
+
+	if err := a.sc.Reload(nsc); err != nil {
+		return err
+	}
+	a.cfg = next
+	return nil
+}
+
+// update check routes the same way as the config file and apply them, then save
+// them to the config file if persist is set. The caller holds the lock.
+func (a *admin) update(routes []config.Route, persist bool) (int, []error) {
+	next := *a.cfg
+	next.Routes = routes
+	if errors := next.Check(); len(errors) > 0 {
+		return http.StatusUnprocessableEntity, errors
+	}
+
+	if err := a.apply(&next); err != nil {
+		return http.StatusUnprocessableEntity, []error{err}
+	}
+
+	// Saving the routes saves the earlier changes too.
+	a.unsaved = true
+	if persist {
+		if err := next.SaveRoutes(); err != nil {
+			return http.StatusInternalServerError, []error{fmt.Errorf("route was applied but can't be saved: %s", err.Error())}
+		}
+		a.unsaved = false
+	}
+	return http.StatusOK, nil
+}
+
+// version returns a hash of the routes, it changes with every change of a route.
+// The caller holds the lock.
+func (a *admin) version() string {
+	b, _ := json.Marshal(a.cfg.Routes)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:8])
+}
+
+// matches returns an error if the routes have changed since the version, an
+// empty version matches any routes.
+func (a *admin) matches(version string) (int, error) {
+	if version != "" && version != a.version() {
+		return http.StatusPreconditionFailed, fmt.Errorf("routes have changed")
+	}
+	return http.StatusOK, nil
+}
+
+// editable returns an error if the route at an index doesn't exist or is from etcd.
+func (a *admin) editable(i int) (int, error) {
+	if i < 0 || i >= len(a.cfg.Routes) {
+		return http.StatusNotFound, fmt.Errorf("route doesn't exist: %d", i)
+	}
+
+	if s := a.cfg.Routes[i].Source(); s != "" {
+		return http.StatusConflict, fmt.Errorf("route is stored in etcd: %s", s)
+	}
+	return http.StatusOK, nil
+}
+
+// Routes returns the routes of the running server and their version.
+func (a *admin) Routes() ([]interface{}, string) {
+	a.Lock()
+	defer a.Unlock()
+
+	routes := []interface{}{}
+	for _, r := range a.cfg.Routes {
+		routes = append(routes, r)
+	}
+	return routes, a.version()
+}
+
+// AddRoute add a route after the routes of the config file, returns the index of the route.
+func (a *admin) AddRoute(b []byte, version string, persist bool) (int, interface{}, string, int, []error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if code, err := a.matches(version); err != nil {
+		return 0, nil, "", code, []error{err}
+	}
+
+	// Routes from etcd come after the routes of the config file.
+	i := 0
+	for i < len(a.cfg.Routes) && a.cfg.Routes[i].Source() == "" {
+		i++
+	}
+
+	r, errors := config.ParseRoute(fmt.Sprintf("routes[%d]", i), b)
+	if len(errors) > 0 {
+		return 0, nil, "", http.StatusBadRequest, errors
+	}
+
+	routes := append([]config.Route{}, a.cfg.Routes[:i]...)
+	routes = append(routes, r)
+	routes = append(routes, a.cfg.Routes[i:]...)
+	if code, errors := a.update(routes, persist); len(errors) > 0 {
+		return 0, nil, "", code, errors
+	}
+	return i, r, a.version(), http.StatusCreated, nil
+}
+
+// UpdateRoute replace the route at an index if the routes have the version.
+func (a *admin) UpdateRoute(i int, b []byte, version string, persist bool) (interface{}, string, int, []error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if code, err := a.editable(i); err != nil {
+		return nil, "", code, []error{err}
+	}
+	if code, err := a.matches(version); err != nil {
+		return nil, "", code, []error{err}
+	}
+
+	r, errors := config.ParseRoute(fmt.Sprintf("routes[%d]", i), b)
+	if len(errors) > 0 {
+		return nil, "", http.StatusBadRequest, errors
+	}
+
+	routes := append([]config.Route{}, a.cfg.Routes...)
+	routes[i] = r
+	if code, errors := a.update(routes, persist); len(errors) > 0 {
+		return nil, "", code, errors
+	}
+	return r, a.version(), http.StatusOK, nil
+}
+
+// RemoveRoute remove the route at an index if the routes have the version,
+// returns the route that was removed.
+func (a *admin) RemoveRoute(i int, version string, persist bool) (interface{}, string, int, []error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if code, err := a.editable(i); err != nil {
+		return nil, "", code, []error{err}
+	}
+	if code, err := a.matches(version); err != nil {
+		return nil, "", code, []error{err}
+	}
+
+	r := a.cfg.Routes[i]
+	routes := append([]config.Route{}, a.cfg.Routes[:i]...)
+	routes = append(routes, a.cfg.Routes[i+1:]...)
+	if code, errors := a.update(routes, persist); len(errors) > 0 {
+		return nil, "", code, errors
+	}
+	return r, a.version(), http.StatusOK, nil
+}
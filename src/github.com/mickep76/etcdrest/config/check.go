@@ -0,0 +1,338 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/kezhuw/toml"
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
+
+	"github.com/mickep76/etcdrest/convert"
+	"github.com/mickep76/etcdrest/pattern"
+)
+
+// schema is the JSON schema of the config file.
+const schema = `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "etcdrest config",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "templDir": {"type": "string"},
+    "schemaURI": {"type": "string", "pattern": "^(file|https?)://"},
+    "bind": {"type": "string"},
+    "serverURI": {"type": "string"},
+    "envelope": {"type": "boolean"},
+    "indent": {"type": "boolean"},
+    "openAPI": {"type": "string"},
+    "backend": {"enum": ["etcd", "memory"]},
+    "routesPrefix": {"type": "string", "pattern": "^/"},
+    "adminToken": {"type": "string"},
+    "reloadInterval": {"type": "string", "pattern": "^(0|([0-9]+(\\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$"},
+    "etcd": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "peers": {"type": "string"},
+        "cert": {"type": "string"},
+        "key": {"type": "string"},
+        "ca": {"type": "string"},
+        "user": {"type": "string"},
+        "timeout": {"type": ["integer", "string"], "minimum": 0},
+        "cmdTimeout": {"type": ["integer", "string"], "minimum": 0},
+        "apiVersion": {"enum": [2, 3]},
+        "maxTxnOps": {"type": "integer", "minimum": 1}
+      }
+    },
+    "routes": {
+      "type": "array",
+      "items": {"$ref": "#/definitions/route"}
+    }
+  },
+  "definitions": {
+    "route": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["type"],
+      "properties": {
+        "type": {"enum": ["api", "template", "static"]},
+        "endpoint": {"type": "string", "pattern": "^/"},
+        "collection": {"type": "string", "pattern": "^/"},
+        "collectionPath": {"type": "string", "pattern": "^/"},
+        "resource": {"type": "string", "pattern": "^/"},
+        "resourcePath": {"type": "string", "pattern": "^/"},
+        "template": {"type": "string"},
+        "path": {"type": "string"},
+        "dirName": {"type": "string"},
+        "schema": {"type": "string"},
+        "storage": {"enum": ["tree", "blob"]},
+        "idStrategy": {"enum": ["uuid", "ulid", "etcd"]},
+        "indexes": {"$ref": "#/definitions/fields"},
+        "unique": {"$ref": "#/definitions/fields"},
+        "parent": {"type": "string", "pattern": "^/"},
+        "onDelete": {"enum": ["restrict", "cascade"]},
+        "references": {
+          "type": "array",
+          "items": {
+            "type": "object",
+            "additionalProperties": false,
+            "required": ["field", "route"],
+            "properties": {
+              "field": {"type": "string", "minLength": 1},
+              "route": {"type": "string", "pattern": "^/"},
+              "onDelete": {"enum": ["restrict", "cascade", "nullify"]}
+            }
+          }
+        }
+      }
+    },
+    "fields": {
+      "type": "array",
+      "items": {"type": "string", "minLength": 1}
+    }
+  }
+}`
+
+// actionRegexp matches an action in a path template.
+var actionRegexp = regexp.MustCompile(`\{\{(.*?)\}\}`)
+
+// fieldRegexp matches a field of the variables in an action.
+var fieldRegexp = regexp.MustCompile(`(^|[\s(])\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// indexRegexp matches the context of a route in a schema error.
+var indexRegexp = regexp.MustCompile(`\.(\d+)`)
+
+// validateFile validate a config file against the schema of the config.
+func validateFile(fn string, b []byte) []error {
+	var data interface{}
+	switch filepath.Ext(fn) {
+	case ".json":
+		if err := json.Unmarshal(b, &data); err != nil {
+			return []error{err}
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &data); err != nil {
+			return []error{err}
+		}
+		data = convert.YAMLValue(data)
+	case ".toml", ".tml":
+		m := map[string]interface{}{}
+		if err := toml.Unmarshal(b, &m); err != nil {
+			return []error{err}
+		}
+		data = m
+	}
+
+	return schemaErrors(gojsonschema.NewStringLoader(schema), data, func(field string) string {
+		if field == "" {
+			return fn
+		}
+		return field
+	})
+}
+
+// routeSchema returns the schema of a single route.
+func routeSchema() gojsonschema.JSONLoader {
+	var s map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &s); err != nil {
+		panic(err)
+	}
+
+	return gojsonschema.NewGoLoader(map[string]interface{}{
+		"$schema":     s["$schema"],
+		"$ref":        "#/definitions/route",
+		"definitions": s["definitions"],
+	})
+}
+
+// schemaErrors validate data against a schema, name returns how a field is named in an error.
+func schemaErrors(l gojsonschema.JSONLoader, data interface{}, name func(string) string) []error {
+	res, err := gojsonschema.Validate(l, gojsonschema.NewGoLoader(data))
+	if err != nil {
+		return []error{err}
+	}
+
+	var errors []error
+	for _, e := range res.Errors() {
+		field := strings.TrimPrefix(strings.TrimPrefix(e.Context().String("."), "(root)"), ".")
+		field = name(indexRegexp.ReplaceAllString(field, "[$1]"))
+
+		// Descriptions such as "routes.0.type must be one of" already name the field.
+		if d := e.Description(); strings.HasPrefix(d, e.Field()+" ") {
+			errors = append(errors, fmt.Errorf("%s%s", field, strings.TrimPrefix(d, e.Field())))
+		} else {
+			errors = append(errors, fmt.Errorf("%s: %s", field, d))
+		}
+	}
+	return errors
+}
+
+// ParseRoute validate a route in JSON against the schema of a route, problems
+// with the route are prefixed with name.
+func ParseRoute(name string, b []byte) (Route, []error) {
+	var data interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return Route{}, []error{fmt.Errorf("%s: %s", name, err.Error())}
+	}
+
+	errors := schemaErrors(routeSchema(), data, func(field string) string {
+		if field == "" {
+			return name
+		}
+		return name + ": " + field
+	})
+	if len(errors) > 0 {
+		return Route{}, errors
+	}
+
+	var r Route
+	if err := json.Unmarshal(b, &r); err != nil {
+		return Route{}, []error{fmt.Errorf("%s: %s", name, err.Error())}
+	}
+	return r, nil
+}
+
+// AddRoute validate a route in JSON and add it to the config, problems with the
+// route are prefixed with source.
+func (cfg *Config) AddRoute(source string, b []byte) []error {
+	r, errors := ParseRoute(source, b)
+	if len(errors) > 0 {
+		return errors
+	}
+
+	r.source = source
+	cfg.Routes = append(cfg.Routes, r)
+	return nil
+}
+
+// checkPath returns an error if a path template doesn't parse or uses a
+// variable the route doesn't declare.
+func checkPath(name, path, route string) error {
+	if _, err := template.New(name).Parse(path); err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+
+	vars := pattern.Vars(route)
+	for _, a := range actionRegexp.FindAllStringSubmatch(path, -1) {
+		for _, m := range fieldRegexp.FindAllStringSubmatch(a[1], -1) {
+			if !vars[m[2]] {
+				return fmt.Errorf("%s: variable %s isn't in route: %s", name, m[2], route)
+			}
+		}
+	}
+	return nil
+}
+
+// routeName returns the index of a route in the config, or where it was added from.
+func (cfg *Config) routeName(i int) string {
+	if cfg.Routes[i].source != "" {
+		return cfg.Routes[i].source
+	}
+	return fmt.Sprintf("routes[%d]", i)
+}
+
+// Check returns every problem with the routes of the config, each is prefixed with the index of the
+// route or where it was added from.
+func (cfg *Config) Check() []error {
+	var errors []error
+	add := func(i int, format string, args ...interface{}) {
+		errors = append(errors, fmt.Errorf("%s: %s", cfg.routeName(i), fmt.Sprintf(format, args...)))
+	}
+
+	// Routes under a prefix in etcd may not have been added yet.
+	if len(cfg.Routes) < 1 && cfg.RoutesPrefix == "" {
+		errors = append(errors, fmt.Errorf("no routes specified"))
+	}
+
+	resources := map[string]int{}
+	for i, r := range cfg.Routes {
+		if r.Type == "api" && r.Resource != "" {
+			if j, ok := resources[r.Resource]; ok {
+				add(i, "resource is the same as for %s: %s", cfg.routeName(j), r.Resource)
+				continue
+			}
+			resources[r.Resource] = i
+		}
+	}
+
+	for i, r := range cfg.Routes {
+		required := map[string]string{}
+		switch r.Type {
+		case "api":
+			required = map[string]string{
+				"collection":     r.Collection,
+				"collectionPath": r.CollectionPath,
+				"resource":       r.Resource,
+				"resourcePath":   r.ResourcePath,
+				"schema":         r.Schema,
+			}
+		case "template":
+			required = map[string]string{"endpoint": r.Endpoint, "template": r.Template}
+		case "static":
+			required = map[string]string{"endpoint": r.Endpoint, "path": r.Path}
+		}
+
+		missing := false
+		for _, k := range []string{"endpoint", "collection", "collectionPath", "resource", "resourcePath", "schema", "template", "path"} {
+			if v, ok := required[k]; ok && v == "" {
+				add(i, "%s route is missing %s", r.Type, k)
+				missing = true
+			}
+		}
+		if missing {
+			continue
+		}
+
+		if r.Type == "api" {
+			if err := checkPath("collectionPath", r.CollectionPath, r.Collection); err != nil {
+				add(i, "%s", err.Error())
+			}
+			if err := checkPath("resourcePath", r.ResourcePath, r.Resource); err != nil {
+				add(i, "%s", err.Error())
+			}
+			for v := range pattern.Vars(r.Collection) {
+				if !pattern.Vars(r.Resource)[v] {
+					add(i, "variable %s of collection isn't in resource: %s", v, r.Resource)
+				}
+			}
+
+			if r.Parent != "" {
+				if _, ok := resources[r.Parent]; !ok {
+					add(i, "parent isn't the resource of an api route: %s", r.Parent)
+				}
+			}
+			for _, ref := range r.References {
+				if _, ok := resources[ref.Route]; !ok {
+					add(i, "route of reference %s isn't the resource of an api route: %s", ref.Field, ref.Route)
+				}
+			}
+
+			if err := cfg.checkSchema(r.Schema); err != nil {
+				add(i, "%s", err.Error())
+			}
+		}
+	}
+	return errors
+}
+
+// checkSchema returns an error if a schema under a file:// schema URI doesn't exist or can't be compiled.
+func (cfg *Config) checkSchema(name string) error {
+	if !strings.HasPrefix(cfg.SchemaURI, "file://") {
+		return nil
+	}
+
+	if _, err := os.Stat(strings.TrimPrefix(cfg.SchemaURI, "file://") + "/" + name); err != nil {
+		return fmt.Errorf("missing schema: %s", err.Error())
+	}
+
+	if _, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader(cfg.SchemaURI + "/" + name)); err != nil {
+		return fmt.Errorf("can't load schema: %s: %s", name, err.Error())
+	}
+	return nil
+}
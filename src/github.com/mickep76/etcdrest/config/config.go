@@ -20,14 +20,41 @@ import (
 
 // Config struct.
 type Config struct {
-	TemplDir  string  `json:"templDir" yaml:"templDir" toml:"templDir"`
-	SchemaURI string  `json:"schemaURI" yaml:"schemaURI" toml:"schemaURI"`
-	Bind      string  `json:"bind,omitempty" yaml:"bind,omitempty" toml:"bind,omitempty"`
-	ServerURI string  `json:"serverURI" yaml:"serverURI" toml:"serverURI"`
-	Envelope  bool    `json:"envelope" yaml:"evelope" toml:"envelope"`
-	Indent    bool    `json:"indent" yaml:"indent" toml:"indent"`
-	Etcd      Etcd    `json:"etcd,omitempty" yaml:"etcd,omitempty" toml:"etcd,omitempty"`
-	Routes    []Route `json:"routes,omitempty" yaml:"routes,omitempty" toml:"routes,omitempty"`
+	TemplDir       string   `json:"templDir" yaml:"templDir" toml:"templDir"`
+	SchemaURI      string   `json:"schemaURI" yaml:"schemaURI" toml:"schemaURI"`
+	Bind           string   `json:"bind,omitempty" yaml:"bind,omitempty" toml:"bind,omitempty"`
+	ServerURI      string   `json:"serverURI" yaml:"serverURI" toml:"serverURI"`
+	Envelope       bool     `json:"envelope" yaml:"envelope" toml:"envelope"`
+	Indent         bool     `json:"indent" yaml:"indent" toml:"indent"`
+	OpenAPI        string   `json:"openAPI,omitempty" yaml:"openAPI,omitempty" toml:"openAPI,omitempty"`
+	Backend        string   `json:"backend,omitempty" yaml:"backend,omitempty" toml:"backend,omitempty"`
+	Etcd           Etcd     `json:"etcd,omitempty" yaml:"etcd,omitempty" toml:"etcd,omitempty"`
+	RoutesPrefix   string   `json:"routesPrefix,omitempty" yaml:"routesPrefix,omitempty" toml:"routesPrefix,omitempty"`
+	AdminToken     string   `json:"adminToken,omitempty" yaml:"adminToken,omitempty" toml:"adminToken,omitempty"`
+	ReloadInterval Duration `json:"reloadInterval,omitempty" yaml:"reloadInterval,omitempty" toml:"reloadInterval,omitempty"`
+	Routes         []Route  `json:"routes,omitempty" yaml:"routes,omitempty" toml:"routes,omitempty"`
+	file           string
+}
+
+// minReloadInterval is the shortest interval files are checked for changes.
+const minReloadInterval = time.Second
+
+// Duration is a duration written as a string such as "5s" in a config file.
+type Duration time.Duration
+
+// UnmarshalText parse a duration.
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalText format a duration.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
 }
 
 // Etcd struct.
@@ -39,29 +66,49 @@ type Etcd struct {
 	User       string        `json:"user,omitempty" yaml:"user,omitempty" toml:"user,omitempty"`
 	Timeout    time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
 	CmdTimeout time.Duration `json:"cmdTimeout,omitempty" yaml:"cmdTimeout,omitempty" toml:"cmdTimeout,omitempty"`
+	APIVersion int           `json:"apiVersion,omitempty" yaml:"apiVersion,omitempty" toml:"apiVersion,omitempty"`
+	MaxTxnOps  int           `json:"maxTxnOps,omitempty" yaml:"maxTxnOps,omitempty" toml:"maxTxnOps,omitempty"`
 }
 
 // Route struct.
 type Route struct {
-	Endpoint       string `json:"endpoint,omitempty" yaml:"endpoint,omitempty" toml:"endpoint,omitempty"`
-	Collection     string `json:"collection,omitempty" yaml:"collection,omitempty" toml:"collection,omitempty"`
-	CollectionPath string `json:"collectionPath,omitempty" yaml:"collectionPath,omitempty" toml:"collectionPath,omitempty"`
-	Resource       string `json:"resource,omitempty" yaml:"resource,omitempty" toml:"resource,omitempty"`
-	ResourcePath   string `json:"resourcePath,omitempty" yaml:"resourcePath,omitempty" toml:"resourcePath,omitempty"`
-	Type           string `json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"`
-	Template       string `json:"template,omitempty" yaml:"template,omitempty" toml:"template,omitempty"`
-	Path           string `json:"path,omitempty" yaml:"path,omitempty" toml:"path,omitempty"`
-	DirName        string `json:"dirName,omitempty" yaml:"dirName,omitempty" toml:"dirName,omitempty"`
-	Schema         string `json:"schema,omitempty" yaml:"schema,omitempty" toml:"schema,omitempty"`
+	Endpoint       string      `json:"endpoint,omitempty" yaml:"endpoint,omitempty" toml:"endpoint,omitempty"`
+	Collection     string      `json:"collection,omitempty" yaml:"collection,omitempty" toml:"collection,omitempty"`
+	CollectionPath string      `json:"collectionPath,omitempty" yaml:"collectionPath,omitempty" toml:"collectionPath,omitempty"`
+	Resource       string      `json:"resource,omitempty" yaml:"resource,omitempty" toml:"resource,omitempty"`
+	ResourcePath   string      `json:"resourcePath,omitempty" yaml:"resourcePath,omitempty" toml:"resourcePath,omitempty"`
+	Type           string      `json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"`
+	Template       string      `json:"template,omitempty" yaml:"template,omitempty" toml:"template,omitempty"`
+	Path           string      `json:"path,omitempty" yaml:"path,omitempty" toml:"path,omitempty"`
+	DirName        string      `json:"dirName,omitempty" yaml:"dirName,omitempty" toml:"dirName,omitempty"`
+	Schema         string      `json:"schema,omitempty" yaml:"schema,omitempty" toml:"schema,omitempty"`
+	Storage        string      `json:"storage,omitempty" yaml:"storage,omitempty" toml:"storage,omitempty"`
+	IDStrategy     string      `json:"idStrategy,omitempty" yaml:"idStrategy,omitempty" toml:"idStrategy,omitempty"`
+	Indexes        []string    `json:"indexes,omitempty" yaml:"indexes,omitempty" toml:"indexes,omitempty"`
+	Unique         []string    `json:"unique,omitempty" yaml:"unique,omitempty" toml:"unique,omitempty"`
+	Parent         string      `json:"parent,omitempty" yaml:"parent,omitempty" toml:"parent,omitempty"`
+	OnDelete       string      `json:"onDelete,omitempty" yaml:"onDelete,omitempty" toml:"onDelete,omitempty"`
+	References     []Reference `json:"references,omitempty" yaml:"references,omitempty" toml:"references,omitempty"`
+	source         string
+}
+
+// Reference struct.
+type Reference struct {
+	Field    string `json:"field,omitempty" yaml:"field,omitempty" toml:"field,omitempty"`
+	Route    string `json:"route,omitempty" yaml:"route,omitempty" toml:"route,omitempty"`
+	OnDelete string `json:"onDelete,omitempty" yaml:"onDelete,omitempty" toml:"onDelete,omitempty"`
 }
 
 func New() *Config {
 	cfg := Config{
-		TemplDir:  "templates",
-		SchemaURI: "file://schemas",
-		Bind:      "0.0.0.0:8080",
-		Envelope:  false,
-		Indent:    true,
+		TemplDir:       "templates",
+		SchemaURI:      "file://schemas",
+		Bind:           "0.0.0.0:8080",
+		Envelope:       false,
+		Indent:         true,
+		OpenAPI:        "/_openapi.json",
+		Backend:        "etcd",
+		ReloadInterval: Duration(2 * time.Second),
 	}
 
 	hostname, err := os.Hostname()
@@ -74,6 +121,8 @@ func New() *Config {
 		Peers:      "http://127.0.0.1:4001,http://127.0.0.1:2379",
 		Timeout:    time.Second,
 		CmdTimeout: 5 * time.Second,
+		APIVersion: 2,
+		MaxTxnOps:  128,
 	}
 
 	cfg.Routes = []Route{}
@@ -81,7 +130,31 @@ func New() *Config {
 	return &cfg
 }
 
-func (cfg *Config) Load(c *cli.Context) {
+// unsupportedError is returned for a config file that isn't JSON, YAML or TOML.
+type unsupportedError string
+
+func (e unsupportedError) Error() string {
+	return "unsupported data format: " + string(e)
+}
+
+// unmarshal a config file by its extension.
+func unmarshal(fn string, b []byte, v interface{}) error {
+	switch filepath.Ext(fn) {
+	case ".json":
+		return json.Unmarshal(b, v)
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(b, v)
+	case ".toml", ".tml":
+		return toml.Unmarshal(b, v)
+	}
+	return unsupportedError(fn)
+}
+
+// Load config file and override it with options, returns every problem with the config file.
+// The routes are checked with Check.
+func (cfg *Config) Load(c *cli.Context) []error {
+	var errors []error
+
 	// Enable debug.
 	if c.GlobalBool("debug") {
 		log.SetDebug()
@@ -110,7 +183,7 @@ func (cfg *Config) Load(c *cli.Context) {
 	// Check if we have an arg. for config file and that it exist's.
 	if c.GlobalString("config") != "" {
 		if _, err := os.Stat(c.GlobalString("config")); os.IsNotExist(err) {
-			log.Fatalf("Config file doesn't exist: %s", c.GlobalString("config"))
+			return []error{fmt.Errorf("config file doesn't exist: %s", c.GlobalString("config"))}
 		}
 		cfgs = append([]string{c.GlobalString("config")}, cfgs...)
 	}
@@ -121,31 +194,24 @@ func (cfg *Config) Load(c *cli.Context) {
 		}
 
 		log.Infof("Using config file: %s", fn)
+		cfg.file = fn
 
 		// Load config file.
 		b, err := ioutil.ReadFile(fn)
 		if err != nil {
-			log.Fatal(err.Error())
+			return []error{err}
 		}
 
-		switch filepath.Ext(fn) {
-		case ".json":
-			if err := json.Unmarshal(b, cfg); err != nil {
-				log.Fatal(err.Error())
-			}
-		case ".yaml", ".yml":
-			if err := yaml.Unmarshal(b, cfg); err != nil {
-				log.Fatal(err.Error())
-			}
-		case ".toml", ".tml":
-			if err := toml.Unmarshal(b, cfg); err != nil {
-				log.Fatal(err.Error())
-			}
-		default:
-			log.Fatal("unsupported data format")
+		err = unmarshal(fn, b, cfg)
+		if _, ok := err.(unsupportedError); ok {
+			return []error{err}
 		}
 
 		// Validate config using JSON schema.
+		errors = validateFile(fn, b)
+		if err != nil {
+			return append(errors, err)
+		}
 
 		break
 	}
@@ -167,6 +233,22 @@ func (cfg *Config) Load(c *cli.Context) {
 		cfg.ServerURI = c.GlobalString("server-uri")
 	}
 
+	if c.GlobalString("openapi") != "" {
+		cfg.OpenAPI = c.GlobalString("openapi")
+	}
+
+	if c.GlobalString("routes-prefix") != "" {
+		cfg.RoutesPrefix = c.GlobalString("routes-prefix")
+	}
+
+	if c.GlobalString("admin-token") != "" {
+		cfg.AdminToken = c.GlobalString("admin-token")
+	}
+
+	if c.GlobalString("backend") != "" {
+		cfg.Backend = c.GlobalString("backend")
+	}
+
 	if c.GlobalBool("envelope") {
 		cfg.Envelope = true
 	}
@@ -203,6 +285,217 @@ func (cfg *Config) Load(c *cli.Context) {
 	if c.GlobalDuration("command-timeout") != 0 {
 		cfg.Etcd.CmdTimeout = c.GlobalDuration("command-timeout")
 	}
+
+	if c.GlobalIsSet("reload-interval") {
+		cfg.ReloadInterval = Duration(c.GlobalDuration("reload-interval"))
+	}
+
+	if cfg.ReloadInterval != 0 && time.Duration(cfg.ReloadInterval) < minReloadInterval {
+		errors = append(errors, fmt.Errorf("reloadInterval must be 0 or at least %s: %s", minReloadInterval, time.Duration(cfg.ReloadInterval)))
+	}
+
+	if c.GlobalInt("etcd-api-version") != 0 {
+		cfg.Etcd.APIVersion = c.GlobalInt("etcd-api-version")
+	}
+
+	if c.GlobalInt("max-txn-ops") != 0 {
+		cfg.Etcd.MaxTxnOps = c.GlobalInt("max-txn-ops")
+	}
+
+	return errors
+}
+
+// File returns the config file that was loaded, or "" if there was none.
+func (cfg *Config) File() string {
+	return cfg.file
+}
+
+// Source returns the key of a route added from etcd, or "" if it's from the config file.
+func (r Route) Source() string {
+	return r.source
+}
+
+// SaveRoutes write the routes that weren't added from etcd to the config file,
+// only the routes are replaced and the rest of the file is kept as it is.
+func (cfg *Config) SaveRoutes() error {
+	if cfg.file == "" {
+		return fmt.Errorf("no config file to save routes to")
+	}
+
+	info, err := os.Stat(cfg.file)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(cfg.file)
+	if err != nil {
+		return err
+	}
+
+	routes := []Route{}
+	for _, r := range cfg.Routes {
+		if r.source == "" {
+			routes = append(routes, r)
+		}
+	}
+
+	switch filepath.Ext(cfg.file) {
+	case ".json":
+		b, err = replaceJSONRoutes(b, routes)
+	case ".yaml", ".yml":
+		b, err = replaceYAMLRoutes(b, routes)
+	case ".toml", ".tml":
+		b, err = replaceTOMLRoutes(b, routes)
+	default:
+		return fmt.Errorf("unsupported data format: %s", cfg.file)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Make sure the file is still valid and has the routes before it's written.
+	saved := New()
+	if err := unmarshal(cfg.file, b, saved); err != nil {
+		return fmt.Errorf("can't replace routes in config file: %s", err.Error())
+	}
+	if errors := validateFile(cfg.file, b); len(errors) > 0 {
+		return fmt.Errorf("can't replace routes in config file: %s", errors[0].Error())
+	}
+	if len(saved.Routes) != len(routes) {
+		return fmt.Errorf("can't replace routes in config file: %s", cfg.file)
+	}
+
+	return ioutil.WriteFile(cfg.file, b, info.Mode())
+}
+
+// replaceJSONRoutes replace the value of routes in a JSON object, or add it last.
+func replaceJSONRoutes(b []byte, routes []Route) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("config file isn't a JSON object")
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		if t != "routes" {
+			continue
+		}
+
+		// Indent the routes as deep as the key.
+		end := int(dec.InputOffset())
+		start := end - len(v)
+		line := bytes.LastIndexByte(b[:start], '\n') + 1
+		indent := b[line : line+len(b[line:start])-len(bytes.TrimLeft(b[line:start], " \t"))]
+		r, err := json.MarshalIndent(routes, string(indent), "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(append(append([]byte{}, b[:start]...), r...), b[end:]...), nil
+	}
+
+	// Add routes before the end of the object.
+	r, err := json.MarshalIndent(routes, "  ", "  ")
+	if err != nil {
+		return nil, err
+	}
+	end := bytes.LastIndexByte(b, '}')
+	head := bytes.TrimRight(b[:end], " \t\r\n")
+	sep := ",\n"
+	if bytes.HasSuffix(head, []byte("{")) {
+		sep = "\n"
+	}
+	out := append(append([]byte{}, head...), sep+"  \"routes\": "...)
+	out = append(append(out, r...), '\n')
+	return append(out, b[end:]...), nil
+}
+
+// replaceYAMLRoutes replace the top-level routes key of a YAML file, or add it
+// last. Comments and blank lines before the next key are kept.
+func replaceYAMLRoutes(b []byte, routes []Route) ([]byte, error) {
+	r, err := yaml.Marshal(routes)
+	if err != nil {
+		return nil, err
+	}
+	node := []string{"routes:"}
+	for _, l := range strings.Split(strings.TrimRight(string(r), "\n"), "\n") {
+		node = append(node, "  "+l)
+	}
+
+	lines := strings.Split(string(b), "\n")
+	start := -1
+	for i, l := range lines {
+		if strings.HasPrefix(l, "routes:") {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return []byte(strings.TrimRight(string(b), "\n") + "\n" + strings.Join(node, "\n") + "\n"), nil
+	}
+
+	// The value ends at the last indented line before another key.
+	last := start
+	for i := start + 1; i < len(lines); i++ {
+		l := lines[i]
+		t := strings.TrimSpace(l)
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		if l[0] != ' ' && l[0] != '\t' && l[0] != '-' {
+			break
+		}
+		last = i
+	}
+
+	out := append(append(append([]string{}, lines[:start]...), node...), lines[last+1:]...)
+	return []byte(strings.Join(out, "\n")), nil
+}
+
+// replaceTOMLRoutes replace the routes tables of a TOML file with tables added
+// last. Comments and blank lines before the next table are kept, comments
+// right above a routes table are removed with it.
+func replaceTOMLRoutes(b []byte, routes []Route) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(map[string]interface{}{"routes": routes}); err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	skip := false
+	var held []string
+	for _, l := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "[") {
+			name := strings.TrimSpace(strings.Trim(t, "[]"))
+			skip = name == "routes" || strings.HasPrefix(name, "routes.")
+			if !skip {
+				out = append(out, held...)
+			}
+			held = nil
+
+			// Comments right above a routes table go with it.
+			for skip && len(out) > 0 && strings.HasPrefix(strings.TrimSpace(out[len(out)-1]), "#") {
+				out = out[:len(out)-1]
+			}
+		}
+
+		switch {
+		case !skip:
+			out = append(out, l)
+		case t == "" || strings.HasPrefix(t, "#"):
+			held = append(held, l)
+		default:
+			held = nil
+		}
+	}
+	out = append(out, held...)
+	return []byte(strings.Join(out, "\n") + "\n\n" + buf.String()), nil
 }
 
 func (cfg *Config) Print(f string) {
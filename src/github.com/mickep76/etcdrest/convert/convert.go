@@ -0,0 +1,22 @@
+// Package convert converts decoded documents between formats.
+package convert
+
+import "fmt"
+
+// YAMLValue returns data with the keys of YAML maps as strings, so it can be
+// converted to JSON.
+func YAMLValue(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[fmt.Sprint(k)] = YAMLValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = YAMLValue(e)
+		}
+	}
+	return data
+}
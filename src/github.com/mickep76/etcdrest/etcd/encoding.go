@@ -0,0 +1,302 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+)
+
+// typeKey is stored in every directory written with the typed encoding,
+// its value is either "object" or "array".
+const typeKey = "@type"
+
+const (
+	typeObject = "object"
+	typeArray  = "array"
+)
+
+// encode document into keys, scalars are stored as JSON values and every
+// directory is marked with its type so the document can be decoded as is.
+func encode(p string, d interface{}, kvs map[string]string) error {
+	switch v := d.(type) {
+	case map[string]interface{}:
+		kvs[p+"/"+typeKey] = typeObject
+		for k, e := range v {
+			if k == typeKey || k == lockKey {
+				return fmt.Errorf("reserved key: %s for path: %s", k, p)
+			}
+			if !validKey(k) {
+				return fmt.Errorf("invalid key: %q for path: %s", k, p)
+			}
+			if err := encode(p+"/"+k, e, kvs); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		kvs[p+"/"+typeKey] = typeArray
+		for i, e := range v {
+			if err := encode(p+"/"+strconv.Itoa(i), e, kvs); err != nil {
+				return err
+			}
+		}
+	case nil, string, bool, float64, int, int64, json.Number:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		kvs[p] = string(b)
+	default:
+		return fmt.Errorf("unsupported type: %T for path: %s", d, p)
+	}
+
+	return nil
+}
+
+// validKey returns false for keys that can't be stored as a single path element.
+func validKey(k string) bool {
+	return k != "" && k != "." && k != ".." && !strings.Contains(k, "/")
+}
+
+// baseName returns the last element of a key.
+func baseName(k string) string {
+	return k[strings.LastIndex(k, "/")+1:]
+}
+
+// index returns the highest modified index of the values in a tree, ignoring
+// any lock, or zero if there are none.
+func index(n *client.Node) uint64 {
+	if !n.Dir {
+		return n.ModifiedIndex
+	}
+
+	var i uint64
+	for _, c := range n.Nodes {
+		if !c.Dir && baseName(c.Key) == lockKey {
+			continue
+		}
+		if ci := index(c); ci > i {
+			i = ci
+		}
+	}
+	return i
+}
+
+// nodeType returns the type marker of a directory or "" if it has none.
+func nodeType(n *client.Node) string {
+	for _, c := range n.Nodes {
+		if !c.Dir && baseName(c.Key) == typeKey {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// decodeValue decodes a typed value, values not written as JSON are kept as strings.
+func decodeValue(v string) interface{} {
+	var d interface{}
+	if err := json.Unmarshal([]byte(v), &d); err != nil {
+		return v
+	}
+	return d
+}
+
+// decodeString returns a value as a string, unquoting typed string values.
+func decodeString(v string) string {
+	var s string
+	if err := json.Unmarshal([]byte(v), &s); err != nil {
+		return v
+	}
+	return s
+}
+
+// decode a node, directories without a type marker are decoded the same way
+// as etcdmap.Map with every value as a string.
+func decode(n *client.Node, typed bool) interface{} {
+	if !n.Dir {
+		if typed {
+			return decodeValue(n.Value)
+		}
+		return n.Value
+	}
+
+	t := nodeType(n)
+	if t != "" {
+		typed = true
+	}
+
+	if t == typeArray {
+		idx := map[int]interface{}{}
+		keys := []int{}
+		for _, c := range n.Nodes {
+			i, err := strconv.Atoi(baseName(c.Key))
+			if err != nil {
+				continue
+			}
+			idx[i] = decode(c, typed)
+			keys = append(keys, i)
+		}
+		sort.Ints(keys)
+
+		arr := []interface{}{}
+		for _, i := range keys {
+			arr = append(arr, idx[i])
+		}
+		return arr
+	}
+
+	m := make(map[string]interface{})
+	for _, c := range n.Nodes {
+		k := baseName(c.Key)
+		if k == typeKey || k == lockKey {
+			continue
+		}
+		m[k] = decode(c, typed)
+	}
+	return m
+}
+
+// decodeMap returns a document from an etcd directory.
+func decodeMap(root *client.Node) interface{} {
+	if !root.Dir {
+		return map[string]interface{}{}
+	}
+	return decode(root, false)
+}
+
+// decodeArray returns a []interface{} including the directory name inside each entry.
+func decodeArray(root *client.Node, dirName string) []interface{} {
+	v := []interface{}{}
+
+	if dirName == "" {
+		dirName = "dir"
+	}
+
+	for _, n := range root.Nodes {
+		if !n.Dir {
+			continue
+		}
+		if m, ok := decode(n, false).(map[string]interface{}); ok {
+			m[dirName] = baseName(n.Key)
+			v = append(v, m)
+		}
+	}
+	return v
+}
+
+// decodeBlob returns a document stored as a single value, or for a directory
+// the documents stored as single values directly below it.
+func decodeBlob(root *client.Node, table bool, dirName string) (interface{}, error) {
+	if !root.Dir {
+		var d interface{}
+		if err := json.Unmarshal([]byte(root.Value), &d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	if dirName == "" {
+		dirName = "dir"
+	}
+
+	m := make(map[string]interface{})
+	arr := []interface{}{}
+	for _, n := range root.Nodes {
+		if n.Dir {
+			continue
+		}
+
+		var d interface{}
+		if err := json.Unmarshal([]byte(n.Value), &d); err != nil {
+			return nil, fmt.Errorf("%s: %s", n.Key, err.Error())
+		}
+
+		k := baseName(n.Key)
+		if table {
+			if doc, ok := d.(map[string]interface{}); ok {
+				doc[dirName] = k
+				arr = append(arr, doc)
+			}
+			continue
+		}
+		m[k] = d
+	}
+
+	if table {
+		return arr, nil
+	}
+	return m, nil
+}
+
+// names returns the names directly below a path in a list of keys in order,
+// without the type marker and lock.
+func names(p string, keys []string) []string {
+	m := map[string]bool{}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, p+"/") {
+			continue
+		}
+		n := strings.SplitN(k[len(p)+1:], "/", 2)[0]
+		if n != typeKey && n != lockKey {
+			m[n] = true
+		}
+	}
+
+	l := []string{}
+	for n := range m {
+		l = append(l, n)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// tree builds an etcd v2 style node from a flat list of keys.
+func tree(p string, leaves []*client.Node) *client.Node {
+	root := &client.Node{Key: p}
+	dirs := map[string]*client.Node{p: root}
+
+	var mkdir func(string) *client.Node
+	mkdir = func(k string) *client.Node {
+		if n, ok := dirs[k]; ok {
+			return n
+		}
+		i := strings.LastIndex(k, "/")
+		parent := mkdir(k[:i])
+		n := &client.Node{Key: k, Dir: true}
+		parent.Nodes = append(parent.Nodes, n)
+		dirs[k] = n
+		return n
+	}
+
+	for _, leaf := range leaves {
+		k := leaf.Key
+		if k != p && !strings.HasPrefix(k, p+"/") {
+			continue
+		}
+
+		n := *leaf
+		if k == p {
+			n.Nodes = root.Nodes
+			*root = n
+			continue
+		}
+		parent := mkdir(k[:strings.LastIndex(k, "/")])
+		parent.Nodes = append(parent.Nodes, &n)
+	}
+
+	root.Dir = len(root.Nodes) > 0
+
+	var sortNodes func(*client.Node)
+	sortNodes = func(n *client.Node) {
+		sort.Sort(n.Nodes)
+		for _, c := range n.Nodes {
+			sortNodes(c)
+		}
+	}
+	sortNodes(root)
+
+	return root
+}
@@ -0,0 +1,118 @@
+package etcd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+)
+
+// nodes returns the keys of a document as a tree, the way etcd returns it.
+func nodes(p string, kvs map[string]string) *client.Node {
+	leaves := []*client.Node{}
+	for k, v := range kvs {
+		leaves = append(leaves, &client.Node{Key: k, Value: v})
+	}
+	return tree(p, leaves)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		doc  string
+		keys map[string]string
+	}{
+		{`{}`, map[string]string{"/d/@type": "object"}},
+		{`{"a": "x", "b": 1, "c": 1.5, "d": true, "e": null}`, map[string]string{
+			"/d/@type": "object", "/d/a": `"x"`, "/d/b": "1", "/d/c": "1.5", "/d/d": "true", "/d/e": "null",
+		}},
+		{`{"a": "1", "b": "true", "c": "null"}`, map[string]string{
+			"/d/@type": "object", "/d/a": `"1"`, "/d/b": `"true"`, "/d/c": `"null"`,
+		}},
+		{`{"a": [1, "x", [], {}]}`, map[string]string{
+			"/d/@type": "object", "/d/a/@type": "array", "/d/a/0": "1", "/d/a/1": `"x"`,
+			"/d/a/2/@type": "array", "/d/a/3/@type": "object",
+		}},
+		{`{"a": {"b": {"c": "x"}}}`, map[string]string{
+			"/d/@type": "object", "/d/a/@type": "object", "/d/a/b/@type": "object", "/d/a/b/c": `"x"`,
+		}},
+		{`{"a": [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11]}`, nil},
+	}
+
+	for _, tc := range tests {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(tc.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+
+		kvs := map[string]string{}
+		if err := encode("/d", doc, kvs); err != nil {
+			t.Errorf("%s: %s", tc.doc, err.Error())
+			continue
+		}
+		if tc.keys != nil && !reflect.DeepEqual(kvs, tc.keys) {
+			t.Errorf("%s: encoded as %v, want %v", tc.doc, kvs, tc.keys)
+		}
+
+		// Arrays keep their order, also with more than ten elements.
+		if got := decode(nodes("/d", kvs), false); !reflect.DeepEqual(got, doc) {
+			t.Errorf("%s: decoded as %v", tc.doc, got)
+		}
+	}
+}
+
+func TestEncodeRejected(t *testing.T) {
+	for _, doc := range []map[string]interface{}{
+		{"@type": "x"},
+		{"@lock": "x"},
+		{"": "x"},
+		{".": "x"},
+		{"..": "x"},
+		{"a/b": 1},
+		{"a": map[string]interface{}{"b/c": 1}},
+		{"a": []interface{}{map[string]interface{}{"..": 1}}},
+		{"a": struct{}{}},
+	} {
+		if err := encode("/d", doc, map[string]string{}); err == nil {
+			t.Errorf("%v: no error", doc)
+		}
+	}
+}
+
+func TestDecodeUntyped(t *testing.T) {
+	// Trees written before the typed encoding have no type markers, every
+	// value is a string and arrays are objects.
+	kvs := map[string]string{
+		"/d/a":     "1",
+		"/d/b":     "true",
+		"/d/c/0":   "x",
+		"/d/c/1":   "y",
+		"/d/e/f":   `"quoted"`,
+		"/d/@lock": "",
+	}
+	want := map[string]interface{}{
+		"a": "1",
+		"b": "true",
+		"c": map[string]interface{}{"0": "x", "1": "y"},
+		"e": map[string]interface{}{"f": `"quoted"`},
+	}
+	if got := decodeMap(nodes("/d", kvs)); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded as %v, want %v", got, want)
+	}
+
+	// A typed document inside an untyped tree is decoded with its types.
+	kvs["/d/g/@type"] = typeObject
+	kvs["/d/g/h"] = "1"
+	want["g"] = map[string]interface{}{"h": float64(1)}
+	if got := decodeMap(nodes("/d", kvs)); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded as %v, want %v", got, want)
+	}
+}
+
+func TestNames(t *testing.T) {
+	keys := []string{"/d/b/x", "/d/a", "/d/@type", "/d/@lock", "/d/b/y", "/e/c", "/dd/f"}
+	got := names("/d", keys)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("names got %v, want %v", got, want)
+	}
+}
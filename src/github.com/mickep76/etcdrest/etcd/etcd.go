@@ -1,14 +1,13 @@
 package etcd
 
 import (
+	"fmt"
 	"net/http"
-	"reflect"
 	"strings"
 	"time"
 
 	"github.com/coreos/etcd/client"
 	"github.com/coreos/etcd/pkg/transport"
-	"github.com/mickep76/etcdmap"
 	"golang.org/x/net/context"
 
 	"github.com/mickep76/etcdrest/log"
@@ -24,17 +23,103 @@ type Config interface {
 	Pass(string) Config
 	Timeout(time.Duration) Config
 	CmdTimeout(time.Duration) Config
+	APIVersion(int) Config
+	MaxTxnOps(int) Config
+	Backend(string) Config
 	Connect() (Session, error)
 }
 
 // Session interface.
 type Session interface {
-	Put(string, interface{}) (int, error)
-	Delete(string) (int, error)
-	Get(string, bool, string) (interface{}, int, error)
-	GetKeys(...string) ([]string, int, error)
+	Put(context.Context, string, interface{}, *PutOptions) (int, error)
+	PutBlob(context.Context, string, []byte, *PutOptions) (int, error)
+	PutKeys(context.Context, *PutOptions) (int, error)
+	CreateInOrder(context.Context, string) (string, int, error)
+	Delete(context.Context, string, *DeleteOptions) (int, error)
+	Get(context.Context, string, bool, string) (interface{}, uint64, int, error)
+	GetBlob(context.Context, string, bool, string) (interface{}, uint64, int, error)
+	GetKeys(context.Context, ...string) ([]string, int, error)
+	List(context.Context, string) ([]string, int, error)
+	Watch(context.Context, string, uint64) Watcher
 }
 
+// PutOptions struct.
+type PutOptions struct {
+	// PrevIndex is the index the document must have, zero means no check.
+	PrevIndex uint64
+
+	// PrevNoExist means the document must not exist.
+	PrevNoExist bool
+
+	// TTL is the time before a document written with PutBlob expires, zero means never.
+	TTL time.Duration
+
+	// SetKeys are keys outside the document, such as index keys, set in the same write.
+	SetKeys map[string]string
+
+	// DeleteKeys are keys outside the document deleted in the same write.
+	DeleteKeys []string
+
+	// ClaimKeys are keys outside the document, such as unique constraints, set
+	// in the same write. The write fails with a ClaimError if a key is already
+	// set to another value.
+	ClaimKeys map[string]string
+
+	// ReleaseKeys are claimed keys deleted in the same write if they still have the value.
+	ReleaseKeys map[string]string
+}
+
+// ClaimError is returned when a key claimed by a write is held by another value.
+type ClaimError struct {
+	Key    string
+	Holder string
+}
+
+func (e *ClaimError) Error() string {
+	return fmt.Sprintf("key is claimed by %s: %s", e.Holder, e.Key)
+}
+
+// DeleteOptions struct.
+type DeleteOptions struct {
+	// PrevIndex is the index the document must have, zero means no check.
+	PrevIndex uint64
+
+	// DeleteKeys are keys outside the document deleted in the same write.
+	DeleteKeys []string
+
+	// ReleaseKeys are claimed keys deleted in the same write if they still have the value.
+	ReleaseKeys map[string]string
+}
+
+// checkIndex checks the conditions of a write against the current index of
+// a document, where zero means the document doesn't exist.
+func checkIndex(p string, index, prevIndex uint64, prevNoExist bool) (int, error) {
+	if prevNoExist && index != 0 {
+		return http.StatusPreconditionFailed, fmt.Errorf("document already exists: %s", p)
+	}
+
+	if prevIndex != 0 && index != prevIndex {
+		return http.StatusPreconditionFailed, fmt.Errorf("document has been modified: %s", p)
+	}
+
+	return http.StatusOK, nil
+}
+
+// failed returns the status code for a failed command, gateway timeout if
+// the command timed out.
+func failed(ctx context.Context) int {
+	if ctx.Err() == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// Backends.
+const (
+	BackendEtcd   = "etcd"
+	BackendMemory = "memory"
+)
+
 // config struct.
 type config struct {
 	peers      string
@@ -45,12 +130,16 @@ type config struct {
 	pass       string
 	timeout    time.Duration
 	cmdTimeout time.Duration
+	apiVersion int
+	maxTxnOps  int
+	backend    string
 }
 
 // session struct.
 type session struct {
-	client  client.Client
-	keysAPI client.KeysAPI
+	client     client.Client
+	keysAPI    client.KeysAPI
+	cmdTimeout time.Duration
 }
 
 // New config constructor.
@@ -59,6 +148,9 @@ func New() Config {
 		peers:      "http://127.0.0.1:4001,http://127.0.0.1:2379",
 		timeout:    time.Second,
 		cmdTimeout: time.Second * 5,
+		apiVersion: 2,
+		maxTxnOps:  128,
+		backend:    BackendEtcd,
 	}
 }
 
@@ -102,6 +194,21 @@ func (c *config) CmdTimeout(cmdTimeout time.Duration) Config {
 	return c
 }
 
+func (c *config) APIVersion(apiVersion int) Config {
+	c.apiVersion = apiVersion
+	return c
+}
+
+func (c *config) MaxTxnOps(maxTxnOps int) Config {
+	c.maxTxnOps = maxTxnOps
+	return c
+}
+
+func (c *config) Backend(backend string) Config {
+	c.backend = backend
+	return c
+}
+
 func (c *config) newTransport() (*http.Transport, error) {
 	return transport.NewTransport(transport.TLSInfo{
 		CAFile:   c.ca,
@@ -126,6 +233,22 @@ func (c *config) newClient() (client.Client, error) {
 }
 
 func (c *config) Connect() (Session, error) {
+	switch c.backend {
+	case BackendEtcd:
+	case BackendMemory:
+		return c.connectMemory()
+	default:
+		return nil, fmt.Errorf("unsupported backend: %s", c.backend)
+	}
+
+	switch c.apiVersion {
+	case 2:
+	case 3:
+		return c.connectV3()
+	default:
+		return nil, fmt.Errorf("unsupported etcd API version: %d", c.apiVersion)
+	}
+
 	log.Infof("Connect to etcd peers: %s", c.peers)
 	cl, err := c.newClient()
 	if err != nil {
@@ -133,74 +256,580 @@ func (c *config) Connect() (Session, error) {
 	}
 
 	return &session{
-		client:  cl,
-		keysAPI: client.NewKeysAPI(cl),
+		client:     cl,
+		keysAPI:    client.NewKeysAPI(cl),
+		cmdTimeout: c.cmdTimeout,
 	}, nil
 }
 
-// Put document.
-func (s *session) Put(p string, d interface{}) (int, error) {
-	if err := etcdmap.Create(s.keysAPI, p, reflect.ValueOf(d)); err != nil {
-		return http.StatusInternalServerError, err
+// Put replace document.
+func (s *session) Put(ctx context.Context, p string, d interface{}, opts *PutOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+
+	kvs := map[string]string{}
+	if err := encode(p, d, kvs); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// Document is a single value.
+	if v, ok := kvs[p]; ok {
+		return s.PutBlob(ctx, p, []byte(v), opts)
+	}
+
+	// Replace a single value with a directory.
+	res, err := s.keysAPI.Get(ctx, p, nil)
+	if err != nil && !isNotFound(err) {
+		return failed(ctx), err
+	}
+	if err == nil && !res.Node.Dir {
+		if code, err := checkIndex(p, res.Node.ModifiedIndex, opts.PrevIndex, opts.PrevNoExist); err != nil {
+			return code, err
+		}
+		if _, err := s.keysAPI.Delete(ctx, p, &client.DeleteOptions{PrevIndex: res.Node.ModifiedIndex}); err != nil && !isNotFound(err) {
+			return failed(ctx), err
+		}
+	}
+
+	lock, code, err := s.lock(ctx, p)
+	if err != nil {
+		return code, err
+	}
+	defer func() { s.unlock(lock) }()
+
+	// Check conditions while holding the lock.
+	res, err = s.keysAPI.Get(ctx, p, &client.GetOptions{Recursive: true})
+	if err != nil {
+		return failed(ctx), err
+	}
+	if code, err := checkIndex(p, index(res.Node), opts.PrevIndex, opts.PrevNoExist); err != nil {
+		return code, err
+	}
+
+	claimed, code, err := s.claim(ctx, opts.ClaimKeys)
+	if err != nil {
+		return code, err
+	}
+
+	// Keys changed so far, they are restored to the stored document if the write fails.
+	old := map[string]string{}
+	leaves(res.Node, old)
+	changed := []string{}
+	written := false
+	defer func() {
+		if !written {
+			lock = s.rollback(lock, changed, old)
+			s.unclaim(claimed)
+		}
+	}()
+
+	// Write the new keys before the keys that are not part of the new document
+	// are removed, the type marker of the document is always written so its index changes.
+	for k, v := range kvs {
+		if ov, ok := old[k]; ok && ov == v && k != p+"/"+typeKey {
+			continue
+		}
+
+		changed = append(changed, k)
+		_, err := s.keysAPI.Set(ctx, k, v, nil)
+		if isNotFile(err) || isNotDir(err) {
+			// A value replaces a directory or a directory replaces a value.
+			r := replaced(p, k, old)
+			changed = append(changed, r)
+			if _, err := s.keysAPI.Delete(ctx, r, &client.DeleteOptions{Recursive: true, Dir: true}); err != nil && !isNotFound(err) {
+				return failed(ctx), err
+			}
+			_, err = s.keysAPI.Set(ctx, k, v, nil)
+		}
+		if err != nil {
+			return failed(ctx), err
+		}
+	}
+
+	for _, k := range stale(res.Node, kvs, dirs(p, kvs)) {
+		changed = append(changed, k)
+		if _, err := s.keysAPI.Delete(ctx, k, &client.DeleteOptions{Recursive: true, Dir: true}); err != nil && !isNotFound(err) {
+			return failed(ctx), err
+		}
+	}
+
+	written = true
+	if err := s.keep(ctx, claimed); err != nil {
+		return failed(ctx), err
+	}
+	if err := s.writeKeys(ctx, opts.SetKeys, opts.DeleteKeys); err != nil {
+		return failed(ctx), err
+	}
+	if err := s.release(ctx, opts.ReleaseKeys); err != nil {
+		return failed(ctx), err
+	}
+
+	return http.StatusOK, nil
+}
+
+// replaced returns the key of the stored document that is in the way of a new
+// key, the key itself if it's a directory or the value above it.
+func replaced(p, k string, old map[string]string) string {
+	for i := len(p) + 1; i < len(k); i++ {
+		if k[i] == '/' {
+			if _, ok := old[k[:i]]; ok {
+				return k[:i]
+			}
+		}
+	}
+	return k
+}
+
+// rollback restore the keys changed by a write that failed to the values of the
+// stored document. The lock is renewed so the document stays locked until
+// they are restored, the lock is returned.
+func (s *session) rollback(lock *client.Node, changed []string, old map[string]string) *client.Node {
+	if len(changed) == 0 {
+		return lock
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cmdTimeout)
+	defer cancel()
+
+	n, err := s.relock(ctx, lock)
+	if err != nil {
+		log.Errorf("Can't restore document, lock is lost: %s: %s", lock.Key, err.Error())
+		return lock
+	}
+
+	for i := len(changed) - 1; i >= 0; i-- {
+		if err := s.reset(ctx, changed[i], old); err != nil {
+			log.Errorf("Can't restore document: %s: %s", changed[i], err.Error())
+			break
+		}
+	}
+	return n
+}
+
+// reset set a key and the keys below it back to the values of the stored document.
+func (s *session) reset(ctx context.Context, k string, old map[string]string) error {
+	if _, err := s.keysAPI.Delete(ctx, k, &client.DeleteOptions{Recursive: true, Dir: true}); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	for ok, v := range old {
+		if ok == k || strings.HasPrefix(ok, k+"/") {
+			if _, err := s.keysAPI.Set(ctx, ok, v, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PutBlob replace document with a single value.
+func (s *session) PutBlob(ctx context.Context, p string, b []byte, opts *PutOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+
+	setOpts := &client.SetOptions{PrevIndex: opts.PrevIndex, TTL: opts.TTL}
+	if opts.PrevNoExist {
+		setOpts.PrevExist = client.PrevNoExist
+	}
+
+	claimed, code, err := s.claim(ctx, opts.ClaimKeys)
+	if err != nil {
+		return code, err
+	}
+	written := false
+	defer func() {
+		if !written {
+			s.unclaim(claimed)
+		}
+	}()
+
+	_, err = s.keysAPI.Set(ctx, p, string(b), setOpts)
+	if isNotFile(err) {
+		// Replace a directory with a single value.
+		var res *client.Response
+		res, err = s.keysAPI.Get(ctx, p, &client.GetOptions{Recursive: true})
+		if err != nil && !isNotFound(err) {
+			return failed(ctx), err
+		}
+		if err == nil {
+			if code, err := checkIndex(p, index(res.Node), opts.PrevIndex, opts.PrevNoExist); err != nil {
+				return code, err
+			}
+		}
+		if _, err := s.keysAPI.Delete(ctx, p, &client.DeleteOptions{Recursive: true, Dir: true}); err != nil && !isNotFound(err) {
+			return failed(ctx), err
+		}
+		_, err = s.keysAPI.Set(ctx, p, string(b), &client.SetOptions{PrevExist: client.PrevNoExist, TTL: opts.TTL})
+	}
+	if err != nil {
+		// Document has been modified or already exists.
+		if isTestFailed(err) || isNodeExist(err) || (opts.PrevIndex != 0 && isNotFound(err)) {
+			return http.StatusPreconditionFailed, err
+		}
+
+		return failed(ctx), err
+	}
+
+	written = true
+	if err := s.keep(ctx, claimed); err != nil {
+		return failed(ctx), err
+	}
+	if err := s.writeKeys(ctx, opts.SetKeys, opts.DeleteKeys); err != nil {
+		return failed(ctx), err
+	}
+	if err := s.release(ctx, opts.ReleaseKeys); err != nil {
+		return failed(ctx), err
+	}
+
+	return http.StatusOK, nil
+}
+
+// PutKeys write the keys outside a document without writing a document, such as
+// when the keys of existing documents are added.
+func (s *session) PutKeys(ctx context.Context, opts *PutOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	claimed, code, err := s.claim(ctx, opts.ClaimKeys)
+	if err != nil {
+		return code, err
+	}
+	if err := s.keep(ctx, claimed); err != nil {
+		s.unclaim(claimed)
+		return failed(ctx), err
+	}
+	if err := s.writeKeys(ctx, opts.SetKeys, opts.DeleteKeys); err != nil {
+		return failed(ctx), err
+	}
+	if err := s.release(ctx, opts.ReleaseKeys); err != nil {
+		return failed(ctx), err
 	}
 
 	return http.StatusOK, nil
 }
 
+// claim set keys that must not be set to another value, etcd v2 has no
+// transactions so each key is created atomically before the document is
+// written. The keys created are returned so they can be removed again if the
+// write fails. They expire the same way as a lock until they are kept, so the
+// keys of a write that never finishes are removed.
+func (s *session) claim(ctx context.Context, claims map[string]string) (map[string]string, int, error) {
+	created := map[string]string{}
+	for k, v := range claims {
+		for {
+			_, err := s.keysAPI.Set(ctx, k, v, &client.SetOptions{PrevExist: client.PrevNoExist, TTL: s.lockTTL()})
+			if err == nil {
+				created[k] = v
+				break
+			}
+			if !isNodeExist(err) {
+				s.unclaim(created)
+				return nil, failed(ctx), err
+			}
+
+			// Key is already claimed, by this document or another.
+			res, err := s.keysAPI.Get(ctx, k, nil)
+			if isNotFound(err) {
+				continue
+			}
+			if err != nil {
+				s.unclaim(created)
+				return nil, failed(ctx), err
+			}
+			if res.Node.Value != v {
+				s.unclaim(created)
+				return nil, http.StatusConflict, &ClaimError{Key: k, Holder: res.Node.Value}
+			}
+			break
+		}
+	}
+
+	return created, http.StatusOK, nil
+}
+
+// keep remove the expiry of the keys claimed by a write once it's written.
+func (s *session) keep(ctx context.Context, keys map[string]string) error {
+	for k, v := range keys {
+		if _, err := s.keysAPI.Set(ctx, k, v, &client.SetOptions{PrevValue: v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unclaim remove keys claimed by a write that failed, also when the context
+// of the write has expired.
+func (s *session) unclaim(keys map[string]string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cmdTimeout)
+	defer cancel()
+
+	if err := s.release(ctx, keys); err != nil {
+		log.Infof("Failed to release keys: %s", err.Error())
+	}
+}
+
+// release delete claimed keys that still have the value.
+func (s *session) release(ctx context.Context, keys map[string]string) error {
+	for k, v := range keys {
+		if _, err := s.keysAPI.Delete(ctx, k, &client.DeleteOptions{PrevValue: v}); err != nil && !isNotFound(err) && !isTestFailed(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeKeys set and delete keys outside a document, etcd v2 has no
+// transactions so they are written right after the document.
+func (s *session) writeKeys(ctx context.Context, set map[string]string, del []string) error {
+	for _, k := range del {
+		if _, err := s.keysAPI.Delete(ctx, k, nil); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	for k, v := range set {
+		if _, err := s.keysAPI.Set(ctx, k, v, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateInOrder create an empty key in a directory with a name that is unique
+// and higher than any created before, the name is returned.
+func (s *session) CreateInOrder(ctx context.Context, p string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	res, err := s.keysAPI.CreateInOrder(ctx, p, "", nil)
+	if err != nil {
+		return "", failed(ctx), err
+	}
+
+	return baseName(res.Node.Key), http.StatusOK, nil
+}
+
+// leaves collect the values of the keys of a stored document.
+func leaves(n *client.Node, old map[string]string) {
+	for _, c := range n.Nodes {
+		if c.Dir {
+			leaves(c, old)
+		} else if baseName(c.Key) != lockKey {
+			old[c.Key] = c.Value
+		}
+	}
+}
+
+// stale returns the keys and directories of a stored document that are not in
+// the new document.
+func stale(n *client.Node, kvs map[string]string, dirs map[string]bool) []string {
+	l := []string{}
+	for _, c := range n.Nodes {
+		if dirs[c.Key] {
+			if c.Dir {
+				l = append(l, stale(c, kvs, dirs)...)
+			}
+			continue
+		}
+
+		if _, ok := kvs[c.Key]; ok || baseName(c.Key) == lockKey {
+			continue
+		}
+		l = append(l, c.Key)
+	}
+	return l
+}
+
 // Get document.
-func (s *session) Get(p string, table bool, dirName string) (interface{}, int, error) {
-	res, err := s.keysAPI.Get(context.TODO(), p, &client.GetOptions{Recursive: true})
+func (s *session) Get(ctx context.Context, p string, table bool, dirName string) (interface{}, uint64, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	node, code, err := s.get(ctx, p)
+	if err != nil {
+		return nil, 0, code, err
+	}
+
+	if table {
+		arr := decodeArray(node, dirName)
+		return arr, index(node), http.StatusOK, nil
+	}
+
+	return decodeMap(node), index(node), http.StatusOK, nil
+}
+
+// GetBlob get document stored as a single value.
+func (s *session) GetBlob(ctx context.Context, p string, table bool, dirName string) (interface{}, uint64, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	res, err := s.keysAPI.Get(ctx, p, &client.GetOptions{Recursive: false})
 	if err != nil {
 		// Document doesn't exist.
-		if cerr, ok := err.(client.Error); ok && cerr.Code == 100 {
-			return nil, http.StatusNotFound, err
+		if isNotFound(err) {
+			return nil, 0, http.StatusNotFound, err
 		}
 
 		// Error retrieving document.
-		return nil, http.StatusInternalServerError, err
+		return nil, 0, failed(ctx), err
 	}
 
-	if table {
-		arr := etcdmap.Array(res.Node, dirName)
-		return arr, http.StatusOK, nil
+	doc, err := decodeBlob(res.Node, table, dirName)
+	if err != nil {
+		return nil, 0, http.StatusInternalServerError, err
 	}
 
-	return etcdmap.Map(res.Node), http.StatusOK, nil
+	return doc, index(res.Node), http.StatusOK, nil
+}
+
+// get a consistent tree, waiting for any write in progress to finish.
+func (s *session) get(ctx context.Context, p string) (*client.Node, int, error) {
+	for {
+		res, err := s.keysAPI.Get(ctx, p, &client.GetOptions{Recursive: true})
+		if err != nil {
+			// Document doesn't exist.
+			if isNotFound(err) {
+				return nil, http.StatusNotFound, err
+			}
+
+			// Error retrieving document.
+			return nil, failed(ctx), err
+		}
+
+		if !locked(res.Node) {
+			return res.Node, http.StatusOK, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, failed(ctx), fmt.Errorf("document is being written: %s", p)
+		case <-time.After(lockRetry):
+		}
+	}
 }
 
 // GetKeys substitute keys in order.
-func (s *session) GetKeys(paths ...string) ([]string, int, error) {
+func (s *session) GetKeys(ctx context.Context, paths ...string) ([]string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
 	arr := []string{}
 	for _, p := range paths {
 
-		res, err := s.keysAPI.Get(context.TODO(), p, &client.GetOptions{Recursive: false})
+		res, err := s.keysAPI.Get(ctx, p, &client.GetOptions{Recursive: false})
 		if err != nil {
 			// Document doesn't exist.
-			if cerr, ok := err.(client.Error); ok && cerr.Code == 100 {
+			if isNotFound(err) {
 				return []string{}, http.StatusNotFound, err
 			}
 
 			// Error retrieving document.
-			return []string{}, http.StatusInternalServerError, err
+			return []string{}, failed(ctx), err
 		}
 
 		if res.Node.Value != "" {
-			arr = append(arr, res.Node.Value)
+			arr = append(arr, decodeString(res.Node.Value))
 		}
 	}
 	return arr, http.StatusOK, nil
 }
 
+// List names of the keys directly below a directory in order.
+func (s *session) List(ctx context.Context, p string) ([]string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	res, err := s.keysAPI.Get(ctx, p, &client.GetOptions{Recursive: false})
+	if err != nil {
+		// Directory doesn't exist.
+		if isNotFound(err) {
+			return []string{}, http.StatusNotFound, err
+		}
+
+		// Error retrieving directory.
+		return []string{}, failed(ctx), err
+	}
+
+	keys := []string{}
+	for _, n := range res.Node.Nodes {
+		keys = append(keys, n.Key)
+	}
+	return names(p, keys), http.StatusOK, nil
+}
+
 // Delete document.
-func (s *session) Delete(path string) (int, error) {
-	if _, err := s.keysAPI.Delete(context.TODO(), path, &client.DeleteOptions{Recursive: true}); err != nil {
-		// Pocument doesn't exist.
-		if cerr, ok := err.(client.Error); ok && cerr.Code == 100 {
+func (s *session) Delete(ctx context.Context, p string, opts *DeleteOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+
+	res, err := s.keysAPI.Get(ctx, p, nil)
+	if err != nil {
+		// Document doesn't exist.
+		if isNotFound(err) {
+			return http.StatusNotFound, err
+		}
+
+		// Error deleting document.
+		return failed(ctx), err
+	}
+
+	// Wait for any write in progress, the lock is removed with the document.
+	if res.Node.Dir {
+		lock, code, err := s.lock(ctx, p)
+		if err != nil {
+			return code, err
+		}
+		defer s.unlock(lock)
+
+		if opts.PrevIndex != 0 {
+			res, err := s.keysAPI.Get(ctx, p, &client.GetOptions{Recursive: true})
+			if err != nil {
+				return failed(ctx), err
+			}
+			if code, err := checkIndex(p, index(res.Node), opts.PrevIndex, false); err != nil {
+				return code, err
+			}
+		}
+	}
+
+	delOpts := &client.DeleteOptions{Recursive: true, Dir: res.Node.Dir}
+	if !res.Node.Dir {
+		delOpts.PrevIndex = opts.PrevIndex
+	}
+
+	if _, err := s.keysAPI.Delete(ctx, p, delOpts); err != nil {
+		// Document doesn't exist.
+		if isNotFound(err) {
 			return http.StatusNotFound, err
 		}
 
+		// Document has been modified.
+		if isTestFailed(err) {
+			return http.StatusPreconditionFailed, err
+		}
+
 		// Error deleting document.
-		return http.StatusInternalServerError, err
+		return failed(ctx), err
+	}
+
+	if err := s.writeKeys(ctx, nil, opts.DeleteKeys); err != nil {
+		return failed(ctx), err
+	}
+	if err := s.release(ctx, opts.ReleaseKeys); err != nil {
+		return failed(ctx), err
 	}
 
 	// Return success.
@@ -0,0 +1,125 @@
+package etcd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/mickep76/etcdrest/log"
+)
+
+// lockKey is created in a document directory while it's being written,
+// readers retry until it's gone so they never see a partly written document.
+const lockKey = "@lock"
+
+// lockRetry is the interval between attempts to acquire a lock.
+const lockRetry = 10 * time.Millisecond
+
+func isNotFound(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == client.ErrorCodeKeyNotFound
+}
+
+func isNotDir(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == client.ErrorCodeNotDir
+}
+
+func isNotFile(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == client.ErrorCodeNotFile
+}
+
+func isTestFailed(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == client.ErrorCodeTestFailed
+}
+
+func isNodeExist(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == client.ErrorCodeNodeExist
+}
+
+// lockTTL returns the time a lock is held if it's never unlocked.
+func (s *session) lockTTL() time.Duration {
+	if s.cmdTimeout < time.Second {
+		return time.Second
+	}
+	return s.cmdTimeout
+}
+
+// lock a document using compare-and-swap on its lock key.
+func (s *session) lock(ctx context.Context, p string) (*client.Node, int, error) {
+	for {
+		res, err := s.keysAPI.Set(ctx, p+"/"+lockKey, "", &client.SetOptions{PrevExist: client.PrevNoExist, TTL: s.lockTTL()})
+		if err == nil {
+			return res.Node, http.StatusOK, nil
+		}
+
+		if !isNodeExist(err) {
+			return nil, failed(ctx), err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, failed(ctx), fmt.Errorf("document is locked: %s", p)
+		case <-time.After(lockRetry):
+		}
+	}
+}
+
+// relock renew a lock, or lock the document again if the lock has expired
+// and nobody else has taken it. The renewed lock is returned.
+func (s *session) relock(ctx context.Context, n *client.Node) (*client.Node, error) {
+	res, err := s.keysAPI.Set(ctx, n.Key, "", &client.SetOptions{PrevIndex: n.ModifiedIndex, TTL: s.lockTTL()})
+	if isNotFound(err) {
+		res, err = s.keysAPI.Set(ctx, n.Key, "", &client.SetOptions{PrevExist: client.PrevNoExist, TTL: s.lockTTL()})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Node, nil
+}
+
+// unlock a document, unless the lock has expired and been taken by someone else.
+// The lock is removed even if the command was cancelled.
+func (s *session) unlock(n *client.Node) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cmdTimeout)
+	defer cancel()
+
+	if _, err := s.keysAPI.Delete(ctx, n.Key, &client.DeleteOptions{PrevIndex: n.ModifiedIndex}); err != nil && !isNotFound(err) {
+		log.Infof("Failed to unlock: %s: %s", n.Key, err.Error())
+	}
+
+	// Remove the directory if the lock was all there was, fails if it's not empty.
+	s.keysAPI.Delete(ctx, n.Key[:strings.LastIndex(n.Key, "/")], &client.DeleteOptions{Dir: true})
+}
+
+// locked returns true if a write is in progress anywhere in the tree.
+func locked(n *client.Node) bool {
+	for _, c := range n.Nodes {
+		if c.Dir {
+			if locked(c) {
+				return true
+			}
+		} else if baseName(c.Key) == lockKey {
+			return true
+		}
+	}
+	return false
+}
+
+// dirs returns every directory below the path in a flat list of keys.
+func dirs(p string, kvs map[string]string) map[string]bool {
+	m := map[string]bool{}
+	for k := range kvs {
+		for i := strings.LastIndex(k, "/"); i > len(p); i = strings.LastIndex(k[:i], "/") {
+			m[k[:i]] = true
+		}
+	}
+	return m
+}
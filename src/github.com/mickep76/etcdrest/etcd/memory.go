@@ -0,0 +1,488 @@
+package etcd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/mickep76/etcdrest/log"
+)
+
+// maxHistory is the number of events kept for watchers, the same as etcd v2.
+const maxHistory = 1000
+
+// memory struct, children has the names directly below each directory so a
+// document is found without looking at every key, and expiring has the keys
+// with a TTL.
+type memory struct {
+	mutex    sync.Mutex
+	index    uint64
+	seq      uint64
+	keys     map[string]*client.Node
+	children map[string]map[string]bool
+	expiring map[string]bool
+	history  []memoryEvent
+	changed  chan struct{}
+}
+
+// memoryEvent struct.
+type memoryEvent struct {
+	seq   uint64
+	event *Event
+}
+
+func (c *config) connectMemory() (Session, error) {
+	log.Info("Using in-memory backend")
+	return &memory{
+		keys:     map[string]*client.Node{},
+		children: map[string]map[string]bool{},
+		expiring: map[string]bool{},
+		changed:  make(chan struct{}),
+	}, nil
+}
+
+// set a key and add it to the directories above it.
+func (m *memory) set(n *client.Node) {
+	m.keys[n.Key] = n
+	delete(m.expiring, n.Key)
+	for p := n.Key; p != ""; {
+		i := strings.LastIndex(p, "/")
+		dir, name := p[:i], p[i+1:]
+		if m.children[dir][name] {
+			return
+		}
+		if m.children[dir] == nil {
+			m.children[dir] = map[string]bool{}
+		}
+		m.children[dir][name] = true
+		p = dir
+	}
+}
+
+// unset a key and remove the directories above it that are left empty.
+func (m *memory) unset(k string) {
+	delete(m.keys, k)
+	delete(m.expiring, k)
+	for p := k; p != ""; {
+		if _, ok := m.keys[p]; ok || len(m.children[p]) > 0 {
+			return
+		}
+		delete(m.children, p)
+		i := strings.LastIndex(p, "/")
+		dir, name := p[:i], p[i+1:]
+		delete(m.children[dir], name)
+		p = dir
+	}
+}
+
+// expire delete the keys with a TTL that has passed as a single change, so
+// watchers get an event the same as with etcd.
+func (m *memory) expire() {
+	deletes := []string{}
+	now := time.Now()
+	for k := range m.expiring {
+		if n, ok := m.keys[k]; ok && !now.Before(*n.Expiration) {
+			deletes = append(deletes, k)
+		}
+	}
+	if len(deletes) > 0 {
+		m.commit(deletes, nil)
+	}
+}
+
+// find returns the key and every key below it.
+func (m *memory) find(p string) []*client.Node {
+	leaves := []*client.Node{}
+	if n, ok := m.keys[p]; ok {
+		leaves = append(leaves, n)
+	}
+	for name := range m.children[p] {
+		leaves = append(leaves, m.find(p+"/"+name)...)
+	}
+	return leaves
+}
+
+// checkParents returns an error if a parent of the key is a value.
+func (m *memory) checkParents(p string) error {
+	for i := strings.LastIndex(p, "/"); i > 0; i = strings.LastIndex(p[:i], "/") {
+		if _, ok := m.keys[p[:i]]; ok {
+			return fmt.Errorf("not a directory: %s", p[:i])
+		}
+	}
+	return nil
+}
+
+// existing returns the keys that exist.
+func (m *memory) existing(keys []string) []string {
+	l := []string{}
+	for _, k := range keys {
+		if _, ok := m.keys[k]; ok {
+			l = append(l, k)
+		}
+	}
+	return l
+}
+
+// released returns the claimed keys that still have the value.
+func (m *memory) released(keys map[string]string) []string {
+	l := []string{}
+	for k, v := range keys {
+		if n, ok := m.keys[k]; ok && n.Value == v {
+			l = append(l, k)
+		}
+	}
+	return l
+}
+
+// commit deletes and sets keys as a single change with a new index.
+func (m *memory) commit(deletes []string, puts map[string]string) {
+	m.index++
+
+	events := []*Event{}
+	for _, k := range deletes {
+		m.unset(k)
+		events = append(events, &Event{Action: ActionDelete, Key: k, Index: m.index})
+	}
+
+	for k, v := range puts {
+		n := &client.Node{Key: k, Value: v, CreatedIndex: m.index, ModifiedIndex: m.index}
+		if old, ok := m.keys[k]; ok {
+			n.CreatedIndex = old.CreatedIndex
+		}
+		m.set(n)
+		events = append(events, &Event{Action: ActionPut, Key: k, Index: m.index})
+	}
+
+	for _, e := range events {
+		m.seq++
+		m.history = append(m.history, memoryEvent{seq: m.seq, event: e})
+	}
+	if len(m.history) > maxHistory {
+		m.history = m.history[len(m.history)-maxHistory:]
+	}
+
+	// Wake up watchers.
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// replace the document with a set of keys.
+func (m *memory) replace(p string, kvs map[string]string, opts *PutOptions) (int, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+
+	old := m.find(p)
+	if code, err := checkIndex(p, index(tree(p, old)), opts.PrevIndex, opts.PrevNoExist); err != nil {
+		return code, err
+	}
+
+	if err := m.checkParents(p); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	for k, v := range opts.ClaimKeys {
+		if n, ok := m.keys[k]; ok && n.Value != v {
+			return http.StatusConflict, &ClaimError{Key: k, Holder: n.Value}
+		}
+	}
+
+	deletes := []string{}
+	for _, n := range old {
+		if _, ok := kvs[n.Key]; !ok {
+			deletes = append(deletes, n.Key)
+		}
+	}
+	deletes = append(deletes, m.existing(opts.DeleteKeys)...)
+	deletes = append(deletes, m.released(opts.ReleaseKeys)...)
+
+	puts := map[string]string{}
+	for k, v := range kvs {
+		puts[k] = v
+	}
+	for k, v := range opts.SetKeys {
+		puts[k] = v
+	}
+	for k, v := range opts.ClaimKeys {
+		puts[k] = v
+	}
+
+	m.commit(deletes, puts)
+
+	if opts.TTL > 0 {
+		expiration := time.Now().Add(opts.TTL)
+		for k := range kvs {
+			m.keys[k].Expiration = &expiration
+			m.expiring[k] = true
+		}
+
+		// Expire the keys even if nothing else changes.
+		time.AfterFunc(opts.TTL, func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			m.expire()
+		})
+	}
+
+	return http.StatusOK, nil
+}
+
+// Put replace document.
+func (m *memory) Put(ctx context.Context, p string, d interface{}, opts *PutOptions) (int, error) {
+	kvs := map[string]string{}
+	if err := encode(p, d, kvs); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	return m.replace(p, kvs, opts)
+}
+
+// PutBlob replace document with a single value.
+func (m *memory) PutBlob(ctx context.Context, p string, b []byte, opts *PutOptions) (int, error) {
+	return m.replace(p, map[string]string{p: string(b)}, opts)
+}
+
+// PutKeys write the keys outside a document without writing a document.
+func (m *memory) PutKeys(ctx context.Context, opts *PutOptions) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+
+	for k, v := range opts.ClaimKeys {
+		if n, ok := m.keys[k]; ok && n.Value != v {
+			return http.StatusConflict, &ClaimError{Key: k, Holder: n.Value}
+		}
+	}
+
+	puts := map[string]string{}
+	for k, v := range opts.SetKeys {
+		puts[k] = v
+	}
+	for k, v := range opts.ClaimKeys {
+		puts[k] = v
+	}
+
+	m.commit(append(m.existing(opts.DeleteKeys), m.released(opts.ReleaseKeys)...), puts)
+	return http.StatusOK, nil
+}
+
+// CreateInOrder create an empty key in a directory with a name that is unique
+// and higher than any created before, the name is returned.
+func (m *memory) CreateInOrder(ctx context.Context, p string) (string, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+
+	name := fmt.Sprintf("%020d", m.index+1)
+	if err := m.checkParents(p + "/" + name); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	m.commit(nil, map[string]string{p + "/" + name: ""})
+	return name, http.StatusOK, nil
+}
+
+// get the key and every key below it as a tree.
+func (m *memory) get(p string) (*client.Node, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+
+	leaves := m.find(p)
+
+	// Document doesn't exist.
+	if len(leaves) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("key not found: %s", p)
+	}
+
+	return tree(p, leaves), http.StatusOK, nil
+}
+
+// Get document.
+func (m *memory) Get(ctx context.Context, p string, table bool, dirName string) (interface{}, uint64, int, error) {
+	root, code, err := m.get(p)
+	if err != nil {
+		return nil, 0, code, err
+	}
+
+	if table {
+		return decodeArray(root, dirName), index(root), http.StatusOK, nil
+	}
+
+	return decodeMap(root), index(root), http.StatusOK, nil
+}
+
+// GetBlob get document stored as a single value.
+func (m *memory) GetBlob(ctx context.Context, p string, table bool, dirName string) (interface{}, uint64, int, error) {
+	root, code, err := m.get(p)
+	if err != nil {
+		return nil, 0, code, err
+	}
+
+	doc, err := decodeBlob(root, table, dirName)
+	if err != nil {
+		return nil, 0, http.StatusInternalServerError, err
+	}
+
+	return doc, index(root), http.StatusOK, nil
+}
+
+// GetKeys substitute keys in order.
+func (m *memory) GetKeys(ctx context.Context, paths ...string) ([]string, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+
+	arr := []string{}
+	for _, p := range paths {
+		if n, ok := m.keys[p]; ok {
+			if n.Value != "" {
+				arr = append(arr, decodeString(n.Value))
+			}
+			continue
+		}
+
+		// Document doesn't exist.
+		if len(m.children[p]) == 0 {
+			return []string{}, http.StatusNotFound, fmt.Errorf("key not found: %s", p)
+		}
+	}
+	return arr, http.StatusOK, nil
+}
+
+// List names of the keys directly below a directory in order.
+func (m *memory) List(ctx context.Context, p string) ([]string, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+
+	// Directory doesn't exist.
+	if _, ok := m.keys[p]; !ok && len(m.children[p]) == 0 {
+		return []string{}, http.StatusNotFound, fmt.Errorf("key not found: %s", p)
+	}
+
+	keys := []string{}
+	for n := range m.children[p] {
+		keys = append(keys, p+"/"+n)
+	}
+
+	return names(p, keys), http.StatusOK, nil
+}
+
+// Delete document.
+func (m *memory) Delete(ctx context.Context, p string, opts *DeleteOptions) (int, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+
+	old := m.find(p)
+
+	// Document doesn't exist.
+	if len(old) == 0 {
+		return http.StatusNotFound, fmt.Errorf("key not found: %s", p)
+	}
+
+	if code, err := checkIndex(p, index(tree(p, old)), opts.PrevIndex, false); err != nil {
+		return code, err
+	}
+
+	deletes := []string{}
+	for _, n := range old {
+		deletes = append(deletes, n.Key)
+	}
+	deletes = append(deletes, m.existing(opts.DeleteKeys)...)
+	deletes = append(deletes, m.released(opts.ReleaseKeys)...)
+
+	m.commit(deletes, nil)
+
+	// Return success.
+	return http.StatusOK, nil
+}
+
+// memoryWatcher struct.
+type memoryWatcher struct {
+	memory     *memory
+	p          string
+	afterIndex uint64
+	seq        uint64
+	cleared    bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// Watch key and every key below it for changes after index, zero means from now,
+// until the context is done or the watcher is closed.
+func (m *memory) Watch(ctx context.Context, p string, afterIndex uint64) Watcher {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &memoryWatcher{
+		memory:     m,
+		p:          p,
+		afterIndex: afterIndex,
+		seq:        m.seq,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	// Replay the events kept after the index.
+	if afterIndex != 0 && afterIndex < m.index {
+		w.seq = m.history[0].seq - 1
+		w.cleared = m.history[0].event.Index > afterIndex+1
+	}
+
+	return w
+}
+
+// Next waits for the next event.
+func (w *memoryWatcher) Next() (*Event, int, error) {
+	m := w.memory
+	for {
+		m.mutex.Lock()
+		for _, e := range m.history {
+			if e.seq <= w.seq {
+				continue
+			}
+
+			// Index is older than the events kept.
+			if w.cleared || e.seq > w.seq+1 {
+				m.mutex.Unlock()
+				return nil, http.StatusGone, fmt.Errorf("event index has been cleared: %d", w.afterIndex)
+			}
+
+			w.seq = e.seq
+			if e.event.Index > w.afterIndex && (e.event.Key == w.p || strings.HasPrefix(e.event.Key, w.p+"/")) {
+				m.mutex.Unlock()
+				ev := *e.event
+				return &ev, http.StatusOK, nil
+			}
+		}
+		changed := m.changed
+		m.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-w.ctx.Done():
+			return nil, http.StatusInternalServerError, w.ctx.Err()
+		}
+	}
+}
+
+// Close watcher.
+func (w *memoryWatcher) Close() {
+	w.cancel()
+}
@@ -0,0 +1,84 @@
+package etcd
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func newMemory(t *testing.T) Session {
+	s, err := New().Backend(BackendMemory).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMemoryList(t *testing.T) {
+	s := newMemory(t)
+	ctx := context.Background()
+
+	for _, p := range []string{"/hosts/b", "/hosts/a", "/sites/sto1"} {
+		if _, err := s.Put(ctx, p, map[string]interface{}{"x": map[string]interface{}{"y": "z"}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, _, err := s.List(ctx, "/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List got %v, want %v", names, want)
+	}
+
+	// Directories left empty are removed with the last key.
+	if _, err := s.Delete(ctx, "/hosts/a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Delete(ctx, "/hosts/b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, code, _ := s.List(ctx, "/hosts"); code != http.StatusNotFound {
+		t.Errorf("List of empty directory got %d, want %d", code, http.StatusNotFound)
+	}
+	if _, _, code, _ := s.Get(ctx, "/sites/sto1", false, ""); code != http.StatusOK {
+		t.Errorf("Get got %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestMemoryExpire(t *testing.T) {
+	s := newMemory(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	w := s.Watch(ctx, "/claims", 0)
+	defer w.Close()
+
+	if _, err := s.PutBlob(ctx, "/claims/a", []byte("x"), &PutOptions{TTL: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	ev, _, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Action != ActionPut || ev.Key != "/claims/a" {
+		t.Errorf("first event is %s %s", ev.Action, ev.Key)
+	}
+
+	// The key expires without another change.
+	ev, _, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Action != ActionDelete || ev.Key != "/claims/a" {
+		t.Errorf("second event is %s %s", ev.Action, ev.Key)
+	}
+	if _, _, code, _ := s.GetBlob(ctx, "/claims/a", false, ""); code != http.StatusNotFound {
+		t.Errorf("GetBlob of expired key got %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,792 @@
+package etcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/mickep76/etcdrest/log"
+)
+
+// v3Prefix is the path prefix of the etcd v3 gRPC JSON gateway.
+const v3Prefix = "/v3"
+
+// sessionV3 struct.
+type sessionV3 struct {
+	client     *http.Client
+	endpoints  []string
+	user       string
+	pass       string
+	mutex      sync.Mutex
+	token      string
+	cmdTimeout time.Duration
+	maxTxnOps  int
+}
+
+// v3Error is the error returned by the etcd v3 gateway.
+type v3Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Err     string `json:"error"`
+}
+
+func (e v3Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.Err
+}
+
+type v3KeyValue struct {
+	Key            []byte `json:"key,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+	ModRevision    int64  `json:"mod_revision,string,omitempty"`
+	Version        int64  `json:"version,string,omitempty"`
+	Lease          int64  `json:"lease,string,omitempty"`
+}
+
+type v3Header struct {
+	Revision int64 `json:"revision,string,omitempty"`
+}
+
+type v3RangeRequest struct {
+	Key       []byte `json:"key,omitempty"`
+	RangeEnd  []byte `json:"range_end,omitempty"`
+	KeysOnly  bool   `json:"keys_only,omitempty"`
+	CountOnly bool   `json:"count_only,omitempty"`
+}
+
+type v3RangeResponse struct {
+	Header v3Header     `json:"header"`
+	Kvs    []v3KeyValue `json:"kvs,omitempty"`
+	Count  int64        `json:"count,string,omitempty"`
+}
+
+type v3PutRequest struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type v3DeleteRangeRequest struct {
+	Key      []byte `json:"key,omitempty"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type v3DeleteRangeResponse struct {
+	Deleted int64 `json:"deleted,string,omitempty"`
+}
+
+type v3RequestOp struct {
+	RequestRange       *v3RangeRequest       `json:"request_range,omitempty"`
+	RequestPut         *v3PutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *v3DeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type v3ResponseOp struct {
+	ResponseRange       *v3RangeResponse       `json:"response_range,omitempty"`
+	ResponseDeleteRange *v3DeleteRangeResponse `json:"response_delete_range,omitempty"`
+}
+
+type v3Compare struct {
+	Result      string `json:"result,omitempty"`
+	Target      string `json:"target,omitempty"`
+	Key         []byte `json:"key,omitempty"`
+	RangeEnd    []byte `json:"range_end,omitempty"`
+	ModRevision int64  `json:"mod_revision,string,omitempty"`
+	Value       []byte `json:"value,omitempty"`
+}
+
+type v3TxnRequest struct {
+	Compare []v3Compare   `json:"compare,omitempty"`
+	Success []v3RequestOp `json:"success,omitempty"`
+	Failure []v3RequestOp `json:"failure,omitempty"`
+}
+
+type v3TxnResponse struct {
+	Header    v3Header       `json:"header"`
+	Succeeded bool           `json:"succeeded"`
+	Responses []v3ResponseOp `json:"responses,omitempty"`
+}
+
+type v3LeaseGrantRequest struct {
+	TTL int64 `json:"TTL,string"`
+}
+
+type v3LeaseGrantResponse struct {
+	ID int64 `json:"ID,string"`
+}
+
+type v3LeaseRevokeRequest struct {
+	ID int64 `json:"ID,string"`
+}
+
+type v3AuthRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type v3AuthResponse struct {
+	Token string `json:"token"`
+}
+
+func (c *config) connectV3() (Session, error) {
+	log.Infof("Connect to etcd v3 peers: %s", c.peers)
+	tr, err := c.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	tr.ResponseHeaderTimeout = c.timeout
+
+	s := &sessionV3{
+		client:     &http.Client{Transport: tr},
+		endpoints:  strings.Split(c.peers, ","),
+		user:       c.user,
+		pass:       c.pass,
+		cmdTimeout: c.cmdTimeout,
+		maxTxnOps:  c.maxTxnOps,
+	}
+
+	if c.user != "" {
+		if _, err := s.authenticate(context.Background(), ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// invalidToken returns true if the gateway rejected the auth token, such as
+// when it has expired or the auth store has changed since it was issued.
+func invalidToken(e v3Error) bool {
+	msg := e.Error()
+	return strings.Contains(msg, "invalid auth token") || strings.Contains(msg, "revision of auth store is old")
+}
+
+// authenticate get a new auth token, unless it has been renewed since the
+// rejected token was used. The token is returned.
+func (s *sessionV3) authenticate(ctx context.Context, rejected string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != rejected {
+		return s.token, nil
+	}
+
+	b, err := json.Marshal(&v3AuthRequest{Name: s.user, Password: s.pass})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.send(ctx, "/auth/authenticate", b, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var res v3AuthResponse
+	if err := decodeV3(resp, &res); err != nil {
+		return "", err
+	}
+	s.token = res.Token
+	return s.token, nil
+}
+
+// post a request to the etcd v3 gateway, if the auth token is rejected it
+// authenticates again and retries once.
+func (s *sessionV3) post(ctx context.Context, method string, req interface{}) (*http.Response, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	token := s.token
+	s.mutex.Unlock()
+
+	resp, err := s.send(ctx, method, b, token)
+	if err != nil || resp.StatusCode == http.StatusOK || s.user == "" {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var e v3Error
+	if json.Unmarshal(body, &e) == nil && invalidToken(e) {
+		log.Infof("Auth token rejected, authenticate again: %s", e.Error())
+		if token, err = s.authenticate(ctx, token); err != nil {
+			return nil, err
+		}
+		return s.send(ctx, method, b, token)
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// send a request to the etcd v3 gateway, trying each endpoint in turn.
+func (s *sessionV3) send(ctx context.Context, method string, b []byte, token string) (*http.Response, error) {
+	var lastErr error
+	for _, ep := range s.endpoints {
+		r, err := http.NewRequest("POST", strings.TrimRight(ep, "/")+v3Prefix+method, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		r = r.WithContext(ctx)
+		r.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			r.Header.Set("Authorization", token)
+		}
+
+		resp, err := s.client.Do(r)
+		if err != nil {
+			// Don't try the next endpoint if the command was cancelled or timed out.
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// call a method on the etcd v3 gateway.
+func (s *sessionV3) call(ctx context.Context, method string, req interface{}, res interface{}) error {
+	resp, err := s.post(ctx, method, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return decodeV3(resp, res)
+}
+
+// stream calls a streaming method on the etcd v3 gateway and returns the response body.
+func (s *sessionV3) stream(ctx context.Context, method string, req interface{}) (io.ReadCloser, error) {
+	resp, err := s.post(ctx, method, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, decodeV3(resp, nil)
+	}
+
+	return resp.Body, nil
+}
+
+func decodeV3(resp *http.Response, res interface{}) error {
+	if resp.StatusCode != http.StatusOK {
+		var e v3Error
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+			return fmt.Errorf("etcd v3 gateway: %s", resp.Status)
+		}
+		return e
+	}
+
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (s *sessionV3) txn(ctx context.Context, req *v3TxnRequest) (*v3TxnResponse, error) {
+	var res v3TxnResponse
+	if err := s.call(ctx, "/kv/txn", req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// prefixEnd returns the end of the range covering all keys with the prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// rangeOps returns operations selecting the key and every key below it.
+func rangeOps(p string) []v3RequestOp {
+	return []v3RequestOp{
+		{RequestRange: &v3RangeRequest{Key: []byte(p)}},
+		{RequestRange: &v3RangeRequest{Key: []byte(p + "/"), RangeEnd: prefixEnd(p + "/")}},
+	}
+}
+
+// keyOps returns operations setting and deleting keys outside a document.
+func keyOps(set map[string]string, del []string) []v3RequestOp {
+	ops := []v3RequestOp{}
+	for _, k := range del {
+		ops = append(ops, v3RequestOp{RequestDeleteRange: &v3DeleteRangeRequest{Key: []byte(k)}})
+	}
+	for k, v := range set {
+		ops = append(ops, v3RequestOp{RequestPut: &v3PutRequest{Key: []byte(k), Value: []byte(v)}})
+	}
+	return ops
+}
+
+// claim returns the conditions and operations to claim and release keys
+// outside the document. A claimed key must still be missing or have the same
+// value when the transaction is committed, a released key is only deleted if
+// it still has the value.
+func (s *sessionV3) claim(ctx context.Context, claims, releases map[string]string) ([]v3Compare, []v3RequestOp, int, error) {
+	if len(claims) == 0 && len(releases) == 0 {
+		return nil, nil, http.StatusOK, nil
+	}
+
+	req := &v3TxnRequest{}
+	for _, m := range []map[string]string{claims, releases} {
+		for k := range m {
+			req.Success = append(req.Success, v3RequestOp{RequestRange: &v3RangeRequest{Key: []byte(k)}})
+		}
+	}
+
+	res, err := s.txn(ctx, req)
+	if err != nil {
+		return nil, nil, failed(ctx), err
+	}
+
+	held := map[string]string{}
+	for _, r := range res.Responses {
+		if r.ResponseRange != nil {
+			for _, kv := range r.ResponseRange.Kvs {
+				held[string(kv.Key)] = string(kv.Value)
+			}
+		}
+	}
+
+	cmps := []v3Compare{}
+	ops := []v3RequestOp{}
+	for k, v := range claims {
+		holder, ok := held[k]
+		if ok && holder != v {
+			return nil, nil, http.StatusConflict, &ClaimError{Key: k, Holder: holder}
+		}
+		if ok {
+			cmps = append(cmps, v3Compare{Result: "EQUAL", Target: "VALUE", Key: []byte(k), Value: []byte(v)})
+		} else {
+			cmps = append(cmps, v3Compare{Result: "EQUAL", Target: "VERSION", Key: []byte(k)})
+		}
+		ops = append(ops, v3RequestOp{RequestPut: &v3PutRequest{Key: []byte(k), Value: []byte(v)}})
+	}
+
+	for k, v := range releases {
+		if holder, ok := held[k]; ok && holder == v {
+			cmps = append(cmps, v3Compare{Result: "EQUAL", Target: "VALUE", Key: []byte(k), Value: []byte(v)})
+			ops = append(ops, v3RequestOp{RequestDeleteRange: &v3DeleteRangeRequest{Key: []byte(k)}})
+		}
+	}
+	return cmps, ops, http.StatusOK, nil
+}
+
+// keys returns the key and every key below it without values and the
+// revision they were read at.
+func (s *sessionV3) keys(ctx context.Context, p string) ([]v3KeyValue, int64, error) {
+	res, err := s.txn(ctx, &v3TxnRequest{Success: []v3RequestOp{
+		{RequestRange: &v3RangeRequest{Key: []byte(p), KeysOnly: true}},
+		{RequestRange: &v3RangeRequest{Key: []byte(p + "/"), RangeEnd: prefixEnd(p + "/"), KeysOnly: true}},
+	}})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kvs := []v3KeyValue{}
+	for _, r := range res.Responses {
+		if r.ResponseRange != nil {
+			kvs = append(kvs, r.ResponseRange.Kvs...)
+		}
+	}
+
+	return kvs, res.Header.Revision, nil
+}
+
+// maxRevision returns the highest modified revision of the keys, or zero if there are none.
+func maxRevision(kvs []v3KeyValue) uint64 {
+	var rev int64
+	for _, kv := range kvs {
+		if kv.ModRevision > rev {
+			rev = kv.ModRevision
+		}
+	}
+	return uint64(rev)
+}
+
+// update a document in a transaction that only applies if no key has been
+// modified since the keys were read, retrying until the command times out.
+func (s *sessionV3) update(ctx context.Context, p string, prevIndex uint64, prevNoExist bool, claims, releases map[string]string, ops func([]v3KeyValue) []v3RequestOp) (int, error) {
+	for {
+		kvs, rev, err := s.keys(ctx, p)
+		if err != nil {
+			return failed(ctx), err
+		}
+
+		if code, err := checkIndex(p, maxRevision(kvs), prevIndex, prevNoExist); err != nil {
+			return code, err
+		}
+
+		claimCmps, claimOps, code, err := s.claim(ctx, claims, releases)
+		if err != nil {
+			return code, err
+		}
+
+		// A write is a single transaction, etcd rejects it with more operations than --max-txn-ops.
+		req := &v3TxnRequest{
+			Compare: append([]v3Compare{
+				{Result: "LESS", Target: "MOD", Key: []byte(p), ModRevision: rev + 1},
+				{Result: "LESS", Target: "MOD", Key: []byte(p + "/"), RangeEnd: prefixEnd(p + "/"), ModRevision: rev + 1},
+			}, claimCmps...),
+			Success: append(ops(kvs), claimOps...),
+		}
+		if n := len(req.Success); s.maxTxnOps > 0 && (n > s.maxTxnOps || len(req.Compare) > s.maxTxnOps) {
+			return http.StatusRequestEntityTooLarge, fmt.Errorf("write of %d keys is more than the %d etcd allows in a transaction (maxTxnOps): %s", n, s.maxTxnOps, p)
+		}
+
+		res, err := s.txn(ctx, req)
+		if err != nil {
+			return failed(ctx), err
+		}
+
+		if res.Succeeded {
+			return http.StatusOK, nil
+		}
+
+		if ctx.Err() != nil {
+			return failed(ctx), fmt.Errorf("document is being written: %s", p)
+		}
+	}
+}
+
+// Put replace document in a single transaction.
+func (s *sessionV3) Put(ctx context.Context, p string, d interface{}, opts *PutOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+
+	kvs := map[string]string{}
+	if err := encode(p, d, kvs); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	return s.update(ctx, p, opts.PrevIndex, opts.PrevNoExist, opts.ClaimKeys, opts.ReleaseKeys, func(old []v3KeyValue) []v3RequestOp {
+		// Keys can't be both deleted by range and put in the same transaction,
+		// so delete the keys that are not in the new document one by one.
+		ops := []v3RequestOp{}
+		for _, kv := range old {
+			if _, ok := kvs[string(kv.Key)]; !ok {
+				ops = append(ops, v3RequestOp{RequestDeleteRange: &v3DeleteRangeRequest{Key: kv.Key}})
+			}
+		}
+
+		for k, v := range kvs {
+			ops = append(ops, v3RequestOp{RequestPut: &v3PutRequest{Key: []byte(k), Value: []byte(v)}})
+		}
+		return append(ops, keyOps(opts.SetKeys, opts.DeleteKeys)...)
+	})
+}
+
+// PutBlob replace document with a single value.
+func (s *sessionV3) PutBlob(ctx context.Context, p string, b []byte, opts *PutOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+
+	// Keys expire with a lease.
+	var lease int64
+	if opts.TTL > 0 {
+		ttl := int64(opts.TTL / time.Second)
+		if ttl < 1 {
+			ttl = 1
+		}
+
+		var res v3LeaseGrantResponse
+		if err := s.call(ctx, "/lease/grant", &v3LeaseGrantRequest{TTL: ttl}, &res); err != nil {
+			return failed(ctx), err
+		}
+		lease = res.ID
+	}
+
+	var prev int64
+	code, err := s.update(ctx, p, opts.PrevIndex, opts.PrevNoExist, opts.ClaimKeys, opts.ReleaseKeys, func(old []v3KeyValue) []v3RequestOp {
+		prev = 0
+		for _, kv := range old {
+			if string(kv.Key) == p {
+				prev = kv.Lease
+			}
+		}
+
+		return append([]v3RequestOp{
+			{RequestDeleteRange: &v3DeleteRangeRequest{Key: []byte(p + "/"), RangeEnd: prefixEnd(p + "/")}},
+			{RequestPut: &v3PutRequest{Key: []byte(p), Value: b, Lease: lease}},
+		}, keyOps(opts.SetKeys, opts.DeleteKeys)...)
+	})
+
+	// Each value with a TTL has a lease of its own, revoke the lease that is no longer used.
+	unused := prev
+	if err != nil {
+		unused = lease
+	}
+	if unused != 0 {
+		s.revoke(unused)
+	}
+	return code, err
+}
+
+// revoke a lease, also when the context of the write has expired.
+func (s *sessionV3) revoke(lease int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cmdTimeout)
+	defer cancel()
+
+	if err := s.call(ctx, "/lease/revoke", &v3LeaseRevokeRequest{ID: lease}, &struct{}{}); err != nil {
+		log.Infof("Failed to revoke lease: %d: %s", lease, err.Error())
+	}
+}
+
+// PutKeys write the keys outside a document without writing a document in a single transaction.
+func (s *sessionV3) PutKeys(ctx context.Context, opts *PutOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	for {
+		cmps, ops, code, err := s.claim(ctx, opts.ClaimKeys, opts.ReleaseKeys)
+		if err != nil {
+			return code, err
+		}
+
+		res, err := s.txn(ctx, &v3TxnRequest{Compare: cmps, Success: append(keyOps(opts.SetKeys, opts.DeleteKeys), ops...)})
+		if err != nil {
+			return failed(ctx), err
+		}
+
+		if res.Succeeded {
+			return http.StatusOK, nil
+		}
+
+		if ctx.Err() != nil {
+			return failed(ctx), fmt.Errorf("keys are being written")
+		}
+	}
+}
+
+// CreateInOrder create an empty key in a directory with a name that is unique
+// and higher than any created before, the name is returned. The name is the
+// revision it's expected to be created at, the same as etcd v2.
+func (s *sessionV3) CreateInOrder(ctx context.Context, p string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	for {
+		res, err := s.txn(ctx, &v3TxnRequest{Success: []v3RequestOp{
+			{RequestRange: &v3RangeRequest{Key: []byte(p), CountOnly: true}},
+		}})
+		if err != nil {
+			return "", failed(ctx), err
+		}
+
+		name := fmt.Sprintf("%020d", res.Header.Revision+1)
+		k := []byte(p + "/" + name)
+		res, err = s.txn(ctx, &v3TxnRequest{
+			Compare: []v3Compare{{Result: "EQUAL", Target: "VERSION", Key: k}},
+			Success: []v3RequestOp{{RequestPut: &v3PutRequest{Key: k}}},
+		})
+		if err != nil {
+			return "", failed(ctx), err
+		}
+
+		if res.Succeeded {
+			return name, http.StatusOK, nil
+		}
+
+		if ctx.Err() != nil {
+			return "", failed(ctx), fmt.Errorf("failed to create key in: %s", p)
+		}
+	}
+}
+
+// Get document.
+func (s *sessionV3) Get(ctx context.Context, p string, table bool, dirName string) (interface{}, uint64, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	root, code, err := s.get(ctx, p)
+	if err != nil {
+		return nil, 0, code, err
+	}
+
+	if table {
+		return decodeArray(root, dirName), index(root), http.StatusOK, nil
+	}
+
+	return decodeMap(root), index(root), http.StatusOK, nil
+}
+
+// get the key and every key below it as a tree.
+func (s *sessionV3) get(ctx context.Context, p string) (*client.Node, int, error) {
+	res, err := s.txn(ctx, &v3TxnRequest{Success: rangeOps(p)})
+	if err != nil {
+		return nil, failed(ctx), err
+	}
+
+	kvs := []v3KeyValue{}
+	for _, r := range res.Responses {
+		if r.ResponseRange != nil {
+			kvs = append(kvs, r.ResponseRange.Kvs...)
+		}
+	}
+
+	// Document doesn't exist.
+	if len(kvs) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("key not found: %s", p)
+	}
+
+	leaves := []*client.Node{}
+	for _, kv := range kvs {
+		leaves = append(leaves, &client.Node{
+			Key:           string(kv.Key),
+			Value:         string(kv.Value),
+			CreatedIndex:  uint64(kv.CreateRevision),
+			ModifiedIndex: uint64(kv.ModRevision),
+		})
+	}
+
+	return tree(p, leaves), http.StatusOK, nil
+}
+
+// GetBlob get document stored as a single value.
+func (s *sessionV3) GetBlob(ctx context.Context, p string, table bool, dirName string) (interface{}, uint64, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	root, code, err := s.get(ctx, p)
+	if err != nil {
+		return nil, 0, code, err
+	}
+
+	doc, err := decodeBlob(root, table, dirName)
+	if err != nil {
+		return nil, 0, http.StatusInternalServerError, err
+	}
+
+	return doc, index(root), http.StatusOK, nil
+}
+
+// GetKeys substitute keys in order.
+func (s *sessionV3) GetKeys(ctx context.Context, paths ...string) ([]string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	arr := []string{}
+	for _, p := range paths {
+		res, err := s.txn(ctx, &v3TxnRequest{Success: []v3RequestOp{
+			{RequestRange: &v3RangeRequest{Key: []byte(p)}},
+			{RequestRange: &v3RangeRequest{Key: []byte(p + "/"), RangeEnd: prefixEnd(p + "/"), CountOnly: true}},
+		}})
+		if err != nil {
+			return []string{}, failed(ctx), err
+		}
+
+		key, dir := res.Responses[0].ResponseRange, res.Responses[1].ResponseRange
+		if key != nil && len(key.Kvs) > 0 {
+			if len(key.Kvs[0].Value) > 0 {
+				arr = append(arr, decodeString(string(key.Kvs[0].Value)))
+			}
+			continue
+		}
+
+		// Document doesn't exist.
+		if dir == nil || dir.Count == 0 {
+			return []string{}, http.StatusNotFound, fmt.Errorf("key not found: %s", p)
+		}
+	}
+	return arr, http.StatusOK, nil
+}
+
+// List names of the keys directly below a directory in order.
+func (s *sessionV3) List(ctx context.Context, p string) ([]string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	kvs, _, err := s.keys(ctx, p)
+	if err != nil {
+		return []string{}, failed(ctx), err
+	}
+
+	// Directory doesn't exist.
+	if len(kvs) == 0 {
+		return []string{}, http.StatusNotFound, fmt.Errorf("key not found: %s", p)
+	}
+
+	keys := []string{}
+	for _, kv := range kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return names(p, keys), http.StatusOK, nil
+}
+
+// Delete document.
+func (s *sessionV3) Delete(ctx context.Context, p string, opts *DeleteOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cmdTimeout)
+	defer cancel()
+
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+
+	ops := append([]v3RequestOp{
+		{RequestDeleteRange: &v3DeleteRangeRequest{Key: []byte(p)}},
+		{RequestDeleteRange: &v3DeleteRangeRequest{Key: []byte(p + "/"), RangeEnd: prefixEnd(p + "/")}},
+	}, keyOps(nil, opts.DeleteKeys)...)
+
+	if opts.PrevIndex != 0 || len(opts.ReleaseKeys) > 0 {
+		return s.update(ctx, p, opts.PrevIndex, false, nil, opts.ReleaseKeys, func(old []v3KeyValue) []v3RequestOp {
+			return ops
+		})
+	}
+
+	res, err := s.txn(ctx, &v3TxnRequest{Success: ops})
+	if err != nil {
+		// Error deleting document.
+		return failed(ctx), err
+	}
+
+	// Only the document counts, not the keys outside it.
+	var deleted int64
+	for _, r := range res.Responses[:2] {
+		if r.ResponseDeleteRange != nil {
+			deleted += r.ResponseDeleteRange.Deleted
+		}
+	}
+
+	// Document doesn't exist.
+	if deleted == 0 {
+		return http.StatusNotFound, fmt.Errorf("key not found: %s", p)
+	}
+
+	// Return success.
+	return http.StatusOK, nil
+}
@@ -0,0 +1,260 @@
+package etcd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// gateway is a fake etcd v3 gateway keeping keys in memory, it only
+// implements the transactions used by the v3 session.
+type gateway struct {
+	mutex sync.Mutex
+	rev   int64
+	kvs   map[string]v3KeyValue
+}
+
+// match returns the keys selected by a key and range end, sorted.
+func (g *gateway) match(key, end []byte) []v3KeyValue {
+	kvs := []v3KeyValue{}
+	for k, kv := range g.kvs {
+		if (end == nil && k == string(key)) || (end != nil && k >= string(key) && k < string(end)) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+	return kvs
+}
+
+func (g *gateway) compare(c v3Compare) bool {
+	kvs := g.match(c.Key, c.RangeEnd)
+	switch c.Target {
+	case "MOD":
+		for _, kv := range kvs {
+			if kv.ModRevision >= c.ModRevision {
+				return false
+			}
+		}
+		return true
+	case "VERSION":
+		return len(kvs) == 0
+	case "VALUE":
+		return len(kvs) == 1 && string(kvs[0].Value) == string(c.Value)
+	}
+	return false
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != v3Prefix+"/kv/txn" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req v3TxnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	res := v3TxnResponse{Succeeded: true}
+	for _, c := range req.Compare {
+		res.Succeeded = res.Succeeded && g.compare(c)
+	}
+
+	ops := req.Success
+	if !res.Succeeded {
+		ops = req.Failure
+	}
+
+	written := false
+	for _, op := range ops {
+		switch {
+		case op.RequestRange != nil:
+			kvs := g.match(op.RequestRange.Key, op.RequestRange.RangeEnd)
+			res.Responses = append(res.Responses, v3ResponseOp{ResponseRange: &v3RangeResponse{Kvs: kvs, Count: int64(len(kvs))}})
+		case op.RequestPut != nil:
+			if !written {
+				g.rev++
+				written = true
+			}
+			kv, ok := g.kvs[string(op.RequestPut.Key)]
+			if !ok {
+				kv = v3KeyValue{Key: op.RequestPut.Key, CreateRevision: g.rev}
+			}
+			kv.Value = op.RequestPut.Value
+			kv.ModRevision = g.rev
+			kv.Version++
+			g.kvs[string(kv.Key)] = kv
+		case op.RequestDeleteRange != nil:
+			kvs := g.match(op.RequestDeleteRange.Key, op.RequestDeleteRange.RangeEnd)
+			if len(kvs) > 0 && !written {
+				g.rev++
+				written = true
+			}
+			for _, kv := range kvs {
+				delete(g.kvs, string(kv.Key))
+			}
+			res.Responses = append(res.Responses, v3ResponseOp{ResponseDeleteRange: &v3DeleteRangeResponse{Deleted: int64(len(kvs))}})
+		}
+	}
+
+	res.Header.Revision = g.rev
+	json.NewEncoder(w).Encode(&res)
+}
+
+func newV3(t *testing.T, maxTxnOps int) (Session, *gateway) {
+	g := &gateway{rev: 1, kvs: map[string]v3KeyValue{}}
+	ts := httptest.NewServer(g)
+	t.Cleanup(ts.Close)
+
+	s, err := New().APIVersion(3).Peers(ts.URL).CmdTimeout(time.Second).MaxTxnOps(maxTxnOps).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, g
+}
+
+func TestV3PutGet(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "flat",
+			doc:  map[string]interface{}{"name": "host1", "port": 22, "up": true},
+			want: map[string]interface{}{"name": "host1", "port": float64(22), "up": true},
+		},
+		{
+			name: "nested",
+			doc:  map[string]interface{}{"site": map[string]interface{}{"name": "sto1"}, "tags": []interface{}{"a", "b"}},
+			want: map[string]interface{}{"site": map[string]interface{}{"name": "sto1"}, "tags": []interface{}{"a", "b"}},
+		},
+		{
+			name: "keys removed on replace",
+			doc:  map[string]interface{}{"name": "host1"},
+			want: map[string]interface{}{"name": "host1"},
+		},
+	}
+
+	s, _ := newV3(t, 128)
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, err := s.Put(ctx, "/hosts/host1", tt.doc, nil); err != nil {
+				t.Fatalf("Put got %d: %s", code, err)
+			}
+
+			doc, index, code, err := s.Get(ctx, "/hosts/host1", false, "")
+			if err != nil {
+				t.Fatalf("Get got %d: %s", code, err)
+			}
+			if index == 0 {
+				t.Errorf("Get got index 0")
+			}
+
+			// Compare through JSON, the same as a response.
+			b, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Get got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, _, code, _ := s.Get(ctx, "/hosts/host2", false, ""); code != http.StatusNotFound {
+		t.Errorf("Get of missing document got %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestV3PutRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxTxnOps int
+		doc       interface{}
+		opts      func(index uint64) *PutOptions
+		code      int
+	}{
+		{
+			name:      "invalid key",
+			maxTxnOps: 128,
+			doc:       map[string]interface{}{"a/b": "c"},
+			code:      http.StatusBadRequest,
+		},
+		{
+			name:      "modified since read",
+			maxTxnOps: 128,
+			doc:       map[string]interface{}{"name": "host1"},
+			opts:      func(index uint64) *PutOptions { return &PutOptions{PrevIndex: index + 1} },
+			code:      http.StatusPreconditionFailed,
+		},
+		{
+			name:      "already exists",
+			maxTxnOps: 128,
+			doc:       map[string]interface{}{"name": "host1"},
+			opts:      func(index uint64) *PutOptions { return &PutOptions{PrevNoExist: true} },
+			code:      http.StatusPreconditionFailed,
+		},
+		{
+			name:      "more keys than maxTxnOps",
+			maxTxnOps: 2,
+			doc:       map[string]interface{}{"a": "1", "b": "2", "c": "3"},
+			code:      http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:      "keys removed count towards maxTxnOps",
+			maxTxnOps: 2,
+			doc:       map[string]interface{}{"x": "1", "y": "2"},
+			code:      http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, g := newV3(t, tt.maxTxnOps)
+
+			// The document to replace has a single key, within every maxTxnOps.
+			if code, err := s.Put(ctx, "/hosts/host1", map[string]interface{}{"name": "host0"}, nil); err != nil {
+				t.Fatalf("Put got %d: %s", code, err)
+			}
+			_, index, _, err := s.Get(ctx, "/hosts/host1", false, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var opts *PutOptions
+			if tt.opts != nil {
+				opts = tt.opts(index)
+			}
+
+			rev := g.rev
+			code, err := s.Put(ctx, "/hosts/host1", tt.doc, opts)
+			if err == nil {
+				t.Fatalf("Put got %d, want an error", code)
+			}
+			if code != tt.code {
+				t.Errorf("Put got %d, want %d: %s", code, tt.code, err)
+			}
+			if g.rev != rev {
+				t.Errorf("Put was written to etcd")
+			}
+		})
+	}
+}
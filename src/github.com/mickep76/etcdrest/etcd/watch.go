@@ -0,0 +1,257 @@
+package etcd
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Event actions.
+const (
+	ActionPut    = "put"
+	ActionDelete = "delete"
+)
+
+// Event struct.
+type Event struct {
+	Action string
+	Key    string
+	Index  uint64
+}
+
+// Watcher interface.
+type Watcher interface {
+	Next() (*Event, int, error)
+	Close()
+}
+
+// watcher struct.
+type watcher struct {
+	watcher client.Watcher
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// writes are the documents that are locked, true once a key has changed.
+	writes map[string]bool
+}
+
+// Watch key and every key below it for changes after index, zero means from now,
+// until the context is done or the watcher is closed.
+func (s *session) Watch(ctx context.Context, p string, afterIndex uint64) Watcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &watcher{
+		watcher: s.keysAPI.Watcher(p, &client.WatcherOptions{AfterIndex: afterIndex, Recursive: true}),
+		ctx:     ctx,
+		cancel:  cancel,
+		writes:  map[string]bool{},
+	}
+}
+
+// Next waits for the next event, the keys changed while a document is locked
+// are reported as one event with the index of the unlock.
+func (w *watcher) Next() (*Event, int, error) {
+	for {
+		res, err := w.watcher.Next(w.ctx)
+		if err != nil {
+			// Index is older than the events kept by etcd.
+			if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeEventIndexCleared {
+				return nil, http.StatusGone, err
+			}
+
+			// Error watching document.
+			return nil, http.StatusInternalServerError, err
+		}
+
+		action := ActionPut
+		switch res.Action {
+		case "delete", "compareAndDelete", "expire":
+			action = ActionDelete
+		}
+
+		k := res.Node.Key
+		if baseName(k) == lockKey {
+			doc := k[:strings.LastIndex(k, "/")]
+			if action == ActionPut {
+				if _, ok := w.writes[doc]; !ok {
+					w.writes[doc] = false
+				}
+				continue
+			}
+
+			changed := w.writes[doc]
+			delete(w.writes, doc)
+			if !changed {
+				continue
+			}
+			return &Event{Action: ActionPut, Key: doc, Index: res.Node.ModifiedIndex}, http.StatusOK, nil
+		}
+
+		// A document deleted with its lock ends the write.
+		if action == ActionDelete {
+			for doc := range w.writes {
+				if doc == k || strings.HasPrefix(doc, k+"/") {
+					delete(w.writes, doc)
+				}
+			}
+		}
+
+		if doc, ok := w.locked(k); ok {
+			w.writes[doc] = true
+			continue
+		}
+
+		return &Event{Action: action, Key: k, Index: res.Node.ModifiedIndex}, http.StatusOK, nil
+	}
+}
+
+// locked returns the locked document a key belongs to.
+func (w *watcher) locked(k string) (string, bool) {
+	for doc := range w.writes {
+		if k == doc || strings.HasPrefix(k, doc+"/") {
+			return doc, true
+		}
+	}
+	return "", false
+}
+
+// Close watcher.
+func (w *watcher) Close() {
+	w.cancel()
+}
+
+type v3WatchCreateRequest struct {
+	Key           []byte `json:"key,omitempty"`
+	RangeEnd      []byte `json:"range_end,omitempty"`
+	StartRevision int64  `json:"start_revision,string,omitempty"`
+}
+
+type v3WatchRequest struct {
+	CreateRequest *v3WatchCreateRequest `json:"create_request,omitempty"`
+}
+
+type v3Event struct {
+	Type string     `json:"type,omitempty"`
+	Kv   v3KeyValue `json:"kv"`
+}
+
+type v3WatchResponse struct {
+	Header          v3Header  `json:"header"`
+	Canceled        bool      `json:"canceled,omitempty"`
+	CompactRevision int64     `json:"compact_revision,string,omitempty"`
+	CancelReason    string    `json:"cancel_reason,omitempty"`
+	Events          []v3Event `json:"events,omitempty"`
+}
+
+type v3WatchResult struct {
+	Result *v3WatchResponse `json:"result,omitempty"`
+	Error  *v3Error         `json:"error,omitempty"`
+}
+
+// watcherV3 struct.
+type watcherV3 struct {
+	session    *sessionV3
+	p          string
+	afterIndex uint64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	mutex      sync.Mutex
+	body       io.ReadCloser
+	closed     bool
+	dec        *json.Decoder
+	events     []*Event
+}
+
+// Watch key and every key below it for changes after index, zero means from now,
+// until the context is done or the watcher is closed.
+func (s *sessionV3) Watch(ctx context.Context, p string, afterIndex uint64) Watcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &watcherV3{
+		session:    s,
+		p:          p,
+		afterIndex: afterIndex,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Next waits for the next event.
+func (w *watcherV3) Next() (*Event, int, error) {
+	if w.dec == nil {
+		req := &v3WatchRequest{CreateRequest: &v3WatchCreateRequest{Key: []byte(w.p), RangeEnd: prefixEnd(w.p)}}
+		if w.afterIndex != 0 {
+			req.CreateRequest.StartRevision = int64(w.afterIndex) + 1
+		}
+
+		body, err := w.session.stream(w.ctx, "/watch", req)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		w.mutex.Lock()
+		if w.closed {
+			body.Close()
+		}
+		w.body = body
+		w.mutex.Unlock()
+
+		w.dec = json.NewDecoder(bufio.NewReader(body))
+	}
+
+	for len(w.events) == 0 {
+		var res v3WatchResult
+		if err := w.dec.Decode(&res); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		if res.Error != nil {
+			return nil, http.StatusInternalServerError, *res.Error
+		}
+
+		if res.Result == nil {
+			continue
+		}
+
+		// Revision is older than the events kept by etcd.
+		if res.Result.CompactRevision != 0 {
+			return nil, http.StatusGone, v3Error{Message: "required revision has been compacted"}
+		}
+
+		if res.Result.Canceled {
+			return nil, http.StatusInternalServerError, v3Error{Message: "watch canceled: " + res.Result.CancelReason}
+		}
+
+		for _, e := range res.Result.Events {
+			k := string(e.Kv.Key)
+			if k != w.p && !strings.HasPrefix(k, w.p+"/") {
+				continue
+			}
+
+			action := ActionPut
+			if e.Type == "DELETE" {
+				action = ActionDelete
+			}
+			w.events = append(w.events, &Event{Action: action, Key: k, Index: uint64(e.Kv.ModRevision)})
+		}
+	}
+
+	e := w.events[0]
+	w.events = w.events[1:]
+	return e, http.StatusOK, nil
+}
+
+// Close watcher.
+func (w *watcherV3) Close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.closed = true
+	w.cancel()
+	if w.body != nil {
+		w.body.Close()
+	}
+}
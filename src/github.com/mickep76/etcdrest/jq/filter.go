@@ -0,0 +1,567 @@
+package jq
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func identityFilter(v interface{}) ([]interface{}, error) {
+	return []interface{}{v}, nil
+}
+
+func literalFilter(l interface{}) filter {
+	return func(interface{}) ([]interface{}, error) {
+		return []interface{}{l}, nil
+	}
+}
+
+func pipeFilter(left, right filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		in, err := left(v)
+		if err != nil {
+			return nil, err
+		}
+
+		out := []interface{}{}
+		for _, e := range in {
+			o, err := right(e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, o...)
+		}
+		return out, nil
+	}
+}
+
+func commaFilter(left, right filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		l, err := left(v)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(v)
+		if err != nil {
+			return nil, err
+		}
+		return append(l, r...), nil
+	}
+}
+
+// altFilter returns the outputs of left that are not false or null, or the outputs of right if there are none.
+func altFilter(left, right filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		out := []interface{}{}
+		if l, err := left(v); err == nil {
+			for _, e := range l {
+				if truthy(e) {
+					out = append(out, e)
+				}
+			}
+		}
+		if len(out) > 0 {
+			return out, nil
+		}
+		return right(v)
+	}
+}
+
+// binaryFilter applies an operator to every combination of outputs.
+func binaryFilter(left, right filter, op func(a, b interface{}) (interface{}, error)) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		r, err := right(v)
+		if err != nil {
+			return nil, err
+		}
+		l, err := left(v)
+		if err != nil {
+			return nil, err
+		}
+
+		out := []interface{}{}
+		for _, b := range r {
+			for _, a := range l {
+				o, err := op(a, b)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, o)
+			}
+		}
+		return out, nil
+	}
+}
+
+func plus(a, b interface{}) (interface{}, error) {
+	if a == nil {
+		return b, nil
+	}
+	if b == nil {
+		return a, nil
+	}
+
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x + y, nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x + y, nil
+		}
+	case []interface{}:
+		if y, ok := b.([]interface{}); ok {
+			return append(append([]interface{}{}, x...), y...), nil
+		}
+	case map[string]interface{}:
+		if y, ok := b.(map[string]interface{}); ok {
+			m := map[string]interface{}{}
+			for k, e := range x {
+				m[k] = e
+			}
+			for k, e := range y {
+				m[k] = e
+			}
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("%s and %s cannot be added", typeName(a), typeName(b))
+}
+
+func minus(a, b interface{}) (interface{}, error) {
+	x, xok := a.(float64)
+	y, yok := b.(float64)
+	if !xok || !yok {
+		return nil, fmt.Errorf("%s and %s cannot be subtracted", typeName(a), typeName(b))
+	}
+	return x - y, nil
+}
+
+// index returns the value of a key in an object or an element in an array.
+func index(v, i interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if k, ok := i.(string); ok {
+			return x[k], nil
+		}
+	case []interface{}:
+		if f, ok := i.(float64); ok {
+			n := int(f)
+			if n < 0 {
+				n += len(x)
+			}
+			if n < 0 || n >= len(x) {
+				return nil, nil
+			}
+			return x[n], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot index %s with %s", typeName(v), typeName(i))
+}
+
+func indexFilter(idx filter) filter {
+	return indexOf(identityFilter, idx)
+}
+
+// indexOf indexes the outputs of a filter with the outputs of the index, evaluated on the input.
+func indexOf(f, idx filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		in, err := f(v)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := idx(v)
+		if err != nil {
+			return nil, err
+		}
+
+		out := []interface{}{}
+		for _, e := range in {
+			for _, k := range keys {
+				o, err := index(e, k)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, o)
+			}
+		}
+		return out, nil
+	}
+}
+
+// iterate returns the elements of an array or the values of an object ordered by key.
+func iterate(v interface{}) ([]interface{}, error) {
+	switch x := v.(type) {
+	case []interface{}:
+		return x, nil
+	case map[string]interface{}:
+		keys := []string{}
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		out := []interface{}{}
+		for _, k := range keys {
+			out = append(out, x[k])
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("cannot iterate over %s", typeName(v))
+}
+
+func iterateFilter(v interface{}) ([]interface{}, error) {
+	return iterate(v)
+}
+
+// tryFilter suppresses errors.
+func tryFilter(f filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		out, err := f(v)
+		if err != nil {
+			return []interface{}{}, nil
+		}
+		return out, nil
+	}
+}
+
+func collectFilter(f filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		out, err := f(v)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{append([]interface{}{}, out...)}, nil
+	}
+}
+
+// objectFilter builds an object for every combination of key and value outputs.
+func objectFilter(keys, values []filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		objs := []map[string]interface{}{{}}
+		for i := range keys {
+			ks, err := keys[i](v)
+			if err != nil {
+				return nil, err
+			}
+			vs, err := values[i](v)
+			if err != nil {
+				return nil, err
+			}
+
+			next := []map[string]interface{}{}
+			for _, o := range objs {
+				for _, k := range ks {
+					s, ok := k.(string)
+					if !ok {
+						return nil, fmt.Errorf("object keys must be strings, got %s", typeName(k))
+					}
+					for _, e := range vs {
+						m := map[string]interface{}{}
+						for ok, ov := range o {
+							m[ok] = ov
+						}
+						m[s] = e
+						next = append(next, m)
+					}
+				}
+			}
+			objs = next
+		}
+
+		out := []interface{}{}
+		for _, o := range objs {
+			out = append(out, o)
+		}
+		return out, nil
+	}
+}
+
+// function struct.
+type function struct {
+	arg bool
+	new func(filter) filter
+}
+
+// simple returns a function without arguments that maps each input to one output.
+func simple(fn func(interface{}) (interface{}, error)) function {
+	return function{new: func(filter) filter {
+		return func(v interface{}) ([]interface{}, error) {
+			o, err := fn(v)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{o}, nil
+		}
+	}}
+}
+
+// withArg returns a function with an argument, evaluated on the input, that maps each input to one output.
+func withArg(fn func(v, a interface{}) (interface{}, error)) function {
+	return function{arg: true, new: func(arg filter) filter {
+		return binaryFilter(identityFilter, arg, fn)
+	}}
+}
+
+// stringArg returns a function that takes a string input and a string argument.
+func stringArg(name string, fn func(s, a string) (interface{}, error)) function {
+	return withArg(func(v, a interface{}) (interface{}, error) {
+		s, ok := v.(string)
+		as, aok := a.(string)
+		if !ok || !aok {
+			return nil, fmt.Errorf("%s requires string input and argument, got %s and %s", name, typeName(v), typeName(a))
+		}
+		return fn(s, as)
+	})
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"select": {arg: true, new: func(arg filter) filter {
+			return func(v interface{}) ([]interface{}, error) {
+				conds, err := arg(v)
+				if err != nil {
+					return nil, err
+				}
+				out := []interface{}{}
+				for _, c := range conds {
+					if truthy(c) {
+						out = append(out, v)
+					}
+				}
+				return out, nil
+			}
+		}},
+		"map": {arg: true, new: func(arg filter) filter {
+			return collectFilter(pipeFilter(iterateFilter, arg))
+		}},
+		"empty": {new: func(filter) filter {
+			return func(interface{}) ([]interface{}, error) {
+				return []interface{}{}, nil
+			}
+		}},
+		"not": simple(func(v interface{}) (interface{}, error) {
+			return !truthy(v), nil
+		}),
+		"length": simple(func(v interface{}) (interface{}, error) {
+			switch x := v.(type) {
+			case nil:
+				return float64(0), nil
+			case float64:
+				if x < 0 {
+					return -x, nil
+				}
+				return x, nil
+			case string:
+				return float64(len([]rune(x))), nil
+			case []interface{}:
+				return float64(len(x)), nil
+			case map[string]interface{}:
+				return float64(len(x)), nil
+			}
+			return nil, fmt.Errorf("%s has no length", typeName(v))
+		}),
+		"keys": simple(func(v interface{}) (interface{}, error) {
+			switch x := v.(type) {
+			case map[string]interface{}:
+				keys := []string{}
+				for k := range x {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+
+				out := []interface{}{}
+				for _, k := range keys {
+					out = append(out, k)
+				}
+				return out, nil
+			case []interface{}:
+				out := []interface{}{}
+				for i := range x {
+					out = append(out, float64(i))
+				}
+				return out, nil
+			}
+			return nil, fmt.Errorf("%s has no keys", typeName(v))
+		}),
+		"has": withArg(func(v, a interface{}) (interface{}, error) {
+			switch x := v.(type) {
+			case map[string]interface{}:
+				if k, ok := a.(string); ok {
+					_, ok := x[k]
+					return ok, nil
+				}
+			case []interface{}:
+				if f, ok := a.(float64); ok {
+					return f >= 0 && int(f) < len(x), nil
+				}
+			}
+			return nil, fmt.Errorf("cannot check whether %s has a %s key", typeName(v), typeName(a))
+		}),
+		"contains": withArg(func(v, a interface{}) (interface{}, error) {
+			if typeName(v) != typeName(a) {
+				return nil, fmt.Errorf("%s and %s cannot have their containment checked", typeName(v), typeName(a))
+			}
+			return contains(v, a), nil
+		}),
+		"test": stringArg("test", func(s, a string) (interface{}, error) {
+			re, err := regexp.Compile(a)
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(s), nil
+		}),
+		"startswith": stringArg("startswith", func(s, a string) (interface{}, error) {
+			return strings.HasPrefix(s, a), nil
+		}),
+		"endswith": stringArg("endswith", func(s, a string) (interface{}, error) {
+			return strings.HasSuffix(s, a), nil
+		}),
+		"ascii_downcase": simple(func(v interface{}) (interface{}, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("ascii_downcase requires string input, got %s", typeName(v))
+			}
+			return strings.ToLower(s), nil
+		}),
+		"ascii_upcase": simple(func(v interface{}) (interface{}, error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("ascii_upcase requires string input, got %s", typeName(v))
+			}
+			return strings.ToUpper(s), nil
+		}),
+		"tostring": simple(func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			return string(b), nil
+		}),
+		"tonumber": simple(func(v interface{}) (interface{}, error) {
+			switch x := v.(type) {
+			case float64:
+				return x, nil
+			case string:
+				f, err := strconv.ParseFloat(x, 64)
+				if err != nil {
+					return nil, fmt.Errorf("cannot parse %q as a number", x)
+				}
+				return f, nil
+			}
+			return nil, fmt.Errorf("%s cannot be parsed as a number", typeName(v))
+		}),
+	}
+}
+
+// contains returns true if b is contained in a, substrings for strings and recursively for arrays and objects.
+func contains(a, b interface{}) bool {
+	switch x := a.(type) {
+	case string:
+		return strings.Contains(x, b.(string))
+	case []interface{}:
+		for _, be := range b.([]interface{}) {
+			found := false
+			for _, ae := range x {
+				if typeName(ae) == typeName(be) && contains(ae, be) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		for k, be := range b.(map[string]interface{}) {
+			ae, ok := x[k]
+			if !ok || typeName(ae) != typeName(be) || !contains(ae, be) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// order returns the position of a type in the jq sort order.
+func order(v interface{}) int {
+	switch x := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if x {
+			return 2
+		}
+		return 1
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	}
+	return 6
+}
+
+// Compare returns -1, 0 or 1 comparing two values in jq order,
+// null < false < true < numbers < strings < arrays < objects.
+func Compare(a, b interface{}) int {
+	oa, ob := order(a), order(b)
+	if oa != ob {
+		if oa < ob {
+			return -1
+		}
+		return 1
+	}
+
+	switch x := a.(type) {
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(x, b.(string))
+	case []interface{}:
+		y := b.([]interface{})
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := Compare(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return Compare(float64(len(x)), float64(len(y)))
+	case map[string]interface{}:
+		y := b.(map[string]interface{})
+		ka, _ := functions["keys"].new(nil)(x)
+		kb, _ := functions["keys"].new(nil)(y)
+		if c := Compare(ka[0], kb[0]); c != 0 {
+			return c
+		}
+		for _, k := range ka[0].([]interface{}) {
+			if c := Compare(x[k.(string)], y[k.(string)]); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
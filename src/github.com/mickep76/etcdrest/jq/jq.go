@@ -0,0 +1,93 @@
+// Package jq implements a subset of the jq query language for JSON documents.
+//
+// Supported are paths (.a.b, .[0], .["a"], .[]), optional paths (.a?), pipes,
+// commas, comparisons, and/or, the alternative operator //, + and -, array and
+// object construction and the functions select, map, length, keys, not, has,
+// contains, test, startswith, endswith, tostring, tonumber, ascii_downcase,
+// ascii_upcase and empty.
+package jq
+
+import (
+	"fmt"
+	"strings"
+)
+
+// filter returns the outputs of an expression for an input.
+type filter func(interface{}) ([]interface{}, error)
+
+// Query struct.
+type Query struct {
+	expr string
+	f    filter
+}
+
+// Parse a query expression.
+func Parse(expr string) (*Query, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{toks: toks}
+	f, err := p.pipe()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", describe(t), t.pos)
+	}
+
+	return &Query{expr: expr, f: f}, nil
+}
+
+// Run the query on a document and return the outputs.
+func (q *Query) Run(doc interface{}) ([]interface{}, error) {
+	out, err := q.f(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", q.expr, err.Error())
+	}
+	if out == nil {
+		out = []interface{}{}
+	}
+	return out, nil
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokField:
+		return "." + t.text
+	}
+	return strings.TrimSpace(t.text)
+}
+
+// typeName returns the jq name of the type of a value.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// truthy returns false for false and null, true for anything else.
+func truthy(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return true
+}
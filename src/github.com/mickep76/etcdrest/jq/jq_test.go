@@ -0,0 +1,335 @@
+package jq
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// hosts is the input of most tests, a collection the way it's returned by a GET.
+const hosts = `{
+  "a.example.com": {"site": "sto1", "tenant": "ops", "cpus": 4, "tags": ["web", "prod"],
+    "interfaces": {"eth0": {"ip": "10.0.0.1"}}},
+  "b.example.com": {"site": "sto2", "tenant": "infra", "cpus": 8, "tags": ["db"],
+    "interfaces": {"eth0": {"ip": "10.0.0.2"}, "eth1": {"ip": "10.0.1.2"}}},
+  "c.example.com": {"site": "sto1", "tenant": "infra", "cpus": 2, "tags": [], "interfaces": {}}
+}`
+
+func decode(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid JSON: %s: %s", s, err.Error())
+	}
+	return v
+}
+
+func run(t *testing.T, expr, input string) ([]interface{}, error) {
+	q, err := Parse(expr)
+	if err != nil {
+		t.Fatalf("%s: can't parse: %s", expr, err.Error())
+	}
+	return q.Run(decode(t, input))
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		expr  string
+		input string
+		want  string
+	}{
+		// Paths.
+		{`.`, `{"a": 1}`, `[{"a": 1}]`},
+		{`.a`, `{"a": 1}`, `[1]`},
+		{`.a.b`, `{"a": {"b": "x"}}`, `["x"]`},
+		{`.missing`, `{"a": 1}`, `[null]`},
+		{`.a.b`, `{"a": null}`, `[null]`},
+		{`.["a b"]`, `{"a b": 1}`, `[1]`},
+		{`."a b"`, `{"a b": 1}`, `[1]`},
+		{`.a."b c"`, `{"a": {"b c": 2}}`, `[2]`},
+		{`.[0]`, `[1, 2, 3]`, `[1]`},
+		{`.[-1]`, `[1, 2, 3]`, `[3]`},
+		{`.[5]`, `[1, 2, 3]`, `[null]`},
+		{`.[]`, `[1, 2, 3]`, `[1, 2, 3]`},
+		{`.[]`, `{"b": 2, "a": 1}`, `[1, 2]`},
+		{`.a[]`, `{"a": [1, 2]}`, `[1, 2]`},
+		{`.a[1]`, `{"a": [1, 2]}`, `[2]`},
+		{`.[.k]`, `{"k": "v", "v": 3}`, `[3]`},
+		{`.[]?`, `1`, `[]`},
+		{`.a?`, `[1]`, `[]`},
+
+		// Pipes and commas.
+		{`.a | .b`, `{"a": {"b": 1}}`, `[1]`},
+		{`.a, .b`, `{"a": 1, "b": 2}`, `[1, 2]`},
+		{`.[] | .x`, `[{"x": 1}, {"x": 2}]`, `[1, 2]`},
+		{`(.a, .b) | . + 1`, `{"a": 1, "b": 2}`, `[2, 3]`},
+
+		// Literals.
+		{`true, false, null`, `null`, `[true, false, null]`},
+		{`"s"`, `null`, `["s"]`},
+		{`1.5`, `null`, `[1.5]`},
+		{`-1`, `null`, `[-1]`},
+		{`-.a`, `{"a": 2}`, `[-2]`},
+		{`"a\"b"`, `null`, `["a\"b"]`},
+
+		// Comparisons.
+		{`.a == 1`, `{"a": 1}`, `[true]`},
+		{`.a != 1`, `{"a": 1}`, `[false]`},
+		{`.a < 2`, `{"a": 1}`, `[true]`},
+		{`.a <= 1`, `{"a": 1}`, `[true]`},
+		{`.a > 1`, `{"a": 1}`, `[false]`},
+		{`.a >= 1`, `{"a": 1}`, `[true]`},
+		{`.a == "1"`, `{"a": 1}`, `[false]`},
+		{`.a == {"b": [1]}`, `{"a": {"b": [1]}}`, `[true]`},
+		{`null < false`, `null`, `[true]`},
+		{`1 < "a"`, `null`, `[true]`},
+		{`"a" < []`, `null`, `[true]`},
+		{`[] < {}`, `null`, `[true]`},
+
+		// Boolean operators.
+		{`.a and .b`, `{"a": true, "b": false}`, `[false]`},
+		{`.a or .b`, `{"a": true, "b": false}`, `[true]`},
+		{`.a and .b`, `{"a": 1, "b": "x"}`, `[true]`},
+		{`.a or .b`, `{"a": null, "b": false}`, `[false]`},
+		{`.a == 1 and .b == 2 or .c`, `{"a": 1, "b": 3, "c": true}`, `[true]`},
+
+		// Alternative.
+		{`.a // "d"`, `{"a": null}`, `["d"]`},
+		{`.a // "d"`, `{"a": false}`, `["d"]`},
+		{`.a // "d"`, `{"a": 0}`, `[0]`},
+		{`.a.b // "d"`, `{"a": 1}`, `["d"]`},
+		{`(.[] | select(. > 5)) // 0`, `[1, 2]`, `[0]`},
+
+		// Arithmetic.
+		{`.a + .b`, `{"a": 1, "b": 2}`, `[3]`},
+		{`.a - .b`, `{"a": 1, "b": 2}`, `[-1]`},
+		{`.a + .b`, `{"a": "x", "b": "y"}`, `["xy"]`},
+		{`.a + .b`, `{"a": [1], "b": [2]}`, `[[1, 2]]`},
+		{`.a + .b`, `{"a": {"x": 1, "y": 1}, "b": {"y": 2}}`, `[{"x": 1, "y": 2}]`},
+		{`.a + null`, `{"a": 1}`, `[1]`},
+		{`null + .a`, `{"a": 1}`, `[1]`},
+		{`1 + 2 - 3`, `null`, `[0]`},
+
+		// Construction.
+		{`[]`, `null`, `[[]]`},
+		{`[.[] | .x]`, `[{"x": 1}, {"x": 2}]`, `[[1, 2]]`},
+		{`{}`, `null`, `[{}]`},
+		{`{a: 1}`, `null`, `[{"a": 1}]`},
+		{`{a}`, `{"a": 1, "b": 2}`, `[{"a": 1}]`},
+		{`{"a b"}`, `{"a b": 1}`, `[{"a b": 1}]`},
+		{`{a: .b, c: .d}`, `{"b": 1, "d": 2}`, `[{"a": 1, "c": 2}]`},
+		{`{(.k): .v}`, `{"k": "x", "v": 1}`, `[{"x": 1}]`},
+		{`{a: (1, 2)}`, `null`, `[{"a": 1}, {"a": 2}]`},
+		{`{a: .x // 0}`, `{}`, `[{"a": 0}]`},
+
+		// Functions.
+		{`.[] | select(.a > 1)`, `[{"a": 1}, {"a": 2}]`, `[{"a": 2}]`},
+		{`map(. + 1)`, `[1, 2]`, `[[2, 3]]`},
+		{`map(.a)`, `{"x": {"a": 1}, "y": {"a": 2}}`, `[[1, 2]]`},
+		{`empty`, `1`, `[]`},
+		{`1, empty, 2`, `null`, `[1, 2]`},
+		{`not`, `null`, `[true]`},
+		{`.a | not`, `{"a": 1}`, `[false]`},
+		{`length`, `"héj"`, `[3]`},
+		{`length`, `[1, 2]`, `[2]`},
+		{`length`, `{"a": 1}`, `[1]`},
+		{`length`, `null`, `[0]`},
+		{`length`, `-3`, `[3]`},
+		{`keys`, `{"b": 1, "a": 2}`, `[["a", "b"]]`},
+		{`keys`, `["x", "y"]`, `[[0, 1]]`},
+		{`has("a")`, `{"a": null}`, `[true]`},
+		{`has("b")`, `{"a": null}`, `[false]`},
+		{`has(1)`, `[1, 2]`, `[true]`},
+		{`has(2)`, `[1, 2]`, `[false]`},
+		{`contains("ob")`, `"foobar"`, `[true]`},
+		{`contains(["a"])`, `["a", "b"]`, `[true]`},
+		{`contains(["c"])`, `["a", "b"]`, `[false]`},
+		{`contains({"a": {"b": "x"}})`, `{"a": {"b": "xyz", "c": 1}}`, `[true]`},
+		{`contains({"a": 1})`, `{"a": "1"}`, `[false]`},
+		{`test("^a.c$")`, `"abc"`, `[true]`},
+		{`startswith("ab")`, `"abc"`, `[true]`},
+		{`endswith("ab")`, `"abc"`, `[false]`},
+		{`tostring`, `{"a": 1}`, `["{\"a\":1}"]`},
+		{`tostring`, `"s"`, `["s"]`},
+		{`tonumber`, `"1.5"`, `[1.5]`},
+		{`tonumber`, `2`, `[2]`},
+		{`ascii_downcase`, `"AbC"`, `["abc"]`},
+		{`ascii_upcase`, `"AbC"`, `["ABC"]`},
+
+		// Queries on a collection.
+		{`.[] | select(.site == "sto1") | .tenant`, hosts, `["ops", "infra"]`},
+		{`[.[] | select(.tenant == "infra")] | length`, hosts, `[2]`},
+		{`.[] | select(.tags | contains(["prod"])) | .site`, hosts, `["sto1"]`},
+		{`keys`, hosts, `[["a.example.com", "b.example.com", "c.example.com"]]`},
+		{`.[] | .interfaces[] | .ip`, hosts, `["10.0.0.1", "10.0.0.2", "10.0.1.2"]`},
+		{`[.[] | .cpus] | length`, hosts, `[3]`},
+		{`.[] | select(.cpus >= 4 and .site == "sto2") | {site, cpus}`, hosts, `[{"site": "sto2", "cpus": 8}]`},
+		{`.["b.example.com"].interfaces | keys`, hosts, `[["eth0", "eth1"]]`},
+		{`.[] | select(.interfaces | has("eth1")) | .tenant`, hosts, `["infra"]`},
+		{`.[] | .tags[0] // "none"`, hosts, `["web", "db", "none"]`},
+	}
+
+	for _, test := range tests {
+		out, err := run(t, test.expr, test.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.expr, err.Error())
+			continue
+		}
+
+		want := decode(t, test.want)
+		got := decode(t, mustJSON(t, out))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %s, want %s", test.expr, mustJSON(t, out), test.want)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRunError(t *testing.T) {
+	tests := []struct {
+		expr  string
+		input string
+		err   string
+	}{
+		{`.a`, `[1]`, "cannot index array with string"},
+		{`.[0]`, `{"a": 1}`, "cannot index object with number"},
+		{`.[]`, `1`, "cannot iterate over number"},
+		{`.a + .b`, `{"a": 1, "b": "x"}`, "number and string cannot be added"},
+		{`.a - .b`, `{"a": "x", "b": "y"}`, "string and string cannot be subtracted"},
+		{`{(.a): 1}`, `{"a": 1}`, "object keys must be strings, got number"},
+		{`length`, `true`, "boolean has no length"},
+		{`keys`, `"s"`, "string has no keys"},
+		{`has("a")`, `[1]`, "cannot check whether array has a string key"},
+		{`contains(1)`, `"s"`, "string and number cannot have their containment checked"},
+		{`test("(")`, `"s"`, "missing closing )"},
+		{`startswith(1)`, `"s"`, "startswith requires string input and argument, got string and number"},
+		{`ascii_downcase`, `1`, "ascii_downcase requires string input, got number"},
+		{`tonumber`, `"x"`, `cannot parse "x" as a number`},
+		{`tonumber`, `[]`, "array cannot be parsed as a number"},
+		{`.[] | .a`, `[{"a": 1}, 2]`, "cannot index number with string"},
+	}
+
+	for _, test := range tests {
+		_, err := run(t, test.expr, test.input)
+		if err == nil {
+			t.Errorf("%s: expected error: %s", test.expr, test.err)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), test.expr+": ") || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %q, want %q", test.expr, err.Error(), test.err)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{``, "unexpected end of expression at 0"},
+		{`.a |`, "unexpected end of expression at 4"},
+		{`.a b`, "unexpected b at 3"},
+		{`(.a`, "at 3"},
+		{`[.a`, "at 3"},
+		{`.a[0`, "at 4"},
+		{`{a: 1`, "at 5"},
+		{`{1: 2}`, "unexpected 1 at 1"},
+		{`"abc`, "unterminated string at 0"},
+		{`1e`, "invalid number at 0: 1e"},
+		{`.a & .b`, "unexpected character at 3: &"},
+		{`nosuch`, "unknown function: nosuch at 0"},
+		{`select`, "function select takes an argument at 0"},
+		{`length(1)`, "function length takes no arguments at 0"},
+		{`)`, "unexpected ) at 0"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.expr)
+		if err == nil {
+			t.Errorf("%q: expected error: %s", test.expr, test.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %q, want %q", test.expr, err.Error(), test.err)
+		}
+	}
+}
+
+func TestRunEmptyOutput(t *testing.T) {
+	out, err := run(t, `.[] | select(.a)`, `[]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil || len(out) != 0 {
+		t.Errorf("got %#v, want an empty list", out)
+	}
+}
+
+func TestLex(t *testing.T) {
+	toks, err := lex(`.a | .["b"] // -1.5e2 != "x\ty"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		kind int
+		text string
+	}{
+		{tokField, "a"},
+		{tokOp, "|"},
+		{tokOp, "."},
+		{tokOp, "["},
+		{tokString, `"b"`},
+		{tokOp, "]"},
+		{tokOp, "//"},
+		{tokOp, "-"},
+		{tokNumber, "1.5e2"},
+		{tokOp, "!="},
+		{tokString, `"x\ty"`},
+		{tokEOF, ""},
+	}
+	if len(toks) != len(want) {
+		t.Fatalf("got %d tokens, want %d: %v", len(toks), len(want), toks)
+	}
+	for i, w := range want {
+		if toks[i].kind != w.kind || toks[i].text != w.text {
+			t.Errorf("token %d: got %d %q, want %d %q", i, toks[i].kind, toks[i].text, w.kind, w.text)
+		}
+	}
+	if toks[8].val != 150.0 {
+		t.Errorf("number value: got %v, want 150", toks[8].val)
+	}
+	if toks[10].val != "x\ty" {
+		t.Errorf("string value: got %q, want %q", toks[10].val, "x\ty")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// Sorted in jq order.
+	values := []string{
+		`null`, `false`, `true`, `-1`, `0`, `2.5`, `""`, `"a"`, `"b"`,
+		`[]`, `[1]`, `[1, 2]`, `[2]`, `{}`, `{"a": 2}`, `{"a": 1, "b": 1}`, `{"b": 0}`,
+	}
+
+	for i, a := range values {
+		for j, b := range values {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got := Compare(decode(t, a), decode(t, b)); got != want {
+				t.Errorf("Compare(%s, %s): got %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
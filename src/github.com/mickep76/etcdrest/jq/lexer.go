@@ -0,0 +1,101 @@
+package jq
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Token kinds.
+const (
+	tokEOF = iota
+	tokIdent
+	tokField
+	tokString
+	tokNumber
+	tokOp
+)
+
+// token struct.
+type token struct {
+	kind int
+	text string
+	val  interface{}
+	pos  int
+}
+
+// operators sorted so the longest match is tried first.
+var operators = []string{"==", "!=", "<=", ">=", "//", "<", ">", "|", ",", "(", ")", "[", "]", "{", "}", ":", "?", "+", "-", "."}
+
+func isIdent(r rune, first bool) bool {
+	return r == '_' || unicode.IsLetter(r) || (!first && unicode.IsDigit(r))
+}
+
+// lex splits an expression into tokens.
+func lex(s string) ([]token, error) {
+	toks := []token{}
+	for i := 0; i < len(s); {
+		r := rune(s[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			var v string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &v); err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %s", i, err.Error())
+			}
+			toks = append(toks, token{kind: tokString, text: s[i : j+1], val: v, pos: i})
+			i = j + 1
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.' || s[j] == 'e' || s[j] == 'E') {
+				j++
+			}
+			f, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d: %s", i, s[i:j])
+			}
+			toks = append(toks, token{kind: tokNumber, text: s[i:j], val: f, pos: i})
+			i = j
+		case r == '.' && i+1 < len(s) && isIdent(rune(s[i+1]), true):
+			j := i + 1
+			for j < len(s) && isIdent(rune(s[j]), false) {
+				j++
+			}
+			toks = append(toks, token{kind: tokField, text: s[i+1 : j], pos: i})
+			i = j
+		case isIdent(r, true):
+			j := i
+			for j < len(s) && isIdent(rune(s[j]), false) {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character at %d: %c", i, r)
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(s)}), nil
+}
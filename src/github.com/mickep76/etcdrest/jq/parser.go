@@ -0,0 +1,379 @@
+package jq
+
+import (
+	"fmt"
+)
+
+// parser struct.
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isOp returns true if the next token is the operator.
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+// isKeyword returns true if the next token is the keyword.
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && t.text == kw
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %s got %s at %d", op, describe(t), t.pos)
+	}
+	p.next()
+	return nil
+}
+
+// pipe := comma ('|' pipe)?
+func (p *parser) pipe() (filter, error) {
+	left, err := p.comma()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOp("|") {
+		return left, nil
+	}
+	p.next()
+
+	right, err := p.pipe()
+	if err != nil {
+		return nil, err
+	}
+	return pipeFilter(left, right), nil
+}
+
+// comma := alt (',' alt)*
+func (p *parser) comma() (filter, error) {
+	left, err := p.alt()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(",") {
+		p.next()
+		right, err := p.alt()
+		if err != nil {
+			return nil, err
+		}
+		left = commaFilter(left, right)
+	}
+	return left, nil
+}
+
+// alt := or ('//' or)*
+func (p *parser) alt() (filter, error) {
+	left, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("//") {
+		p.next()
+		right, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		left = altFilter(left, right)
+	}
+	return left, nil
+}
+
+// or := and ('or' and)*
+func (p *parser) or() (filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryFilter(left, right, func(a, b interface{}) (interface{}, error) {
+			return truthy(a) || truthy(b), nil
+		})
+	}
+	return left, nil
+}
+
+// and := cmp ('and' cmp)*
+func (p *parser) and() (filter, error) {
+	left, err := p.cmp()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.cmp()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryFilter(left, right, func(a, b interface{}) (interface{}, error) {
+			return truthy(a) && truthy(b), nil
+		})
+	}
+	return left, nil
+}
+
+// cmp := add (op add)?
+func (p *parser) cmp() (filter, error) {
+	left, err := p.add()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind != tokOp {
+		return left, nil
+	}
+
+	var test func(int) bool
+	switch t.text {
+	case "==":
+		test = func(c int) bool { return c == 0 }
+	case "!=":
+		test = func(c int) bool { return c != 0 }
+	case "<":
+		test = func(c int) bool { return c < 0 }
+	case "<=":
+		test = func(c int) bool { return c <= 0 }
+	case ">":
+		test = func(c int) bool { return c > 0 }
+	case ">=":
+		test = func(c int) bool { return c >= 0 }
+	default:
+		return left, nil
+	}
+	p.next()
+
+	right, err := p.add()
+	if err != nil {
+		return nil, err
+	}
+	return binaryFilter(left, right, func(a, b interface{}) (interface{}, error) {
+		return test(Compare(a, b)), nil
+	}), nil
+}
+
+// add := postfix (('+' | '-') postfix)*
+func (p *parser) add() (filter, error) {
+	left, err := p.postfix()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.next().text
+		right, err := p.postfix()
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			left = binaryFilter(left, right, plus)
+		} else {
+			left = binaryFilter(left, right, minus)
+		}
+	}
+	return left, nil
+}
+
+// postfix := primary suffix*
+func (p *parser) postfix() (filter, error) {
+	f, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return p.suffixes(f)
+}
+
+// suffix := .name | ."name" | [] | [expr] | ?
+func (p *parser) suffixes(f filter) (filter, error) {
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokField:
+			p.next()
+			f = pipeFilter(f, indexFilter(literalFilter(t.text)))
+		case p.isOp(".") && p.toks[p.pos+1].kind == tokString:
+			p.next()
+			f = pipeFilter(f, indexFilter(literalFilter(p.next().val)))
+		case p.isOp("["):
+			p.next()
+			if p.isOp("]") {
+				p.next()
+				f = pipeFilter(f, iterateFilter)
+				continue
+			}
+			idx, err := p.pipe()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			f = indexOf(f, idx)
+		case p.isOp("?"):
+			p.next()
+			f = tryFilter(f)
+		default:
+			return f, nil
+		}
+	}
+}
+
+// primary := . | .name | literal | (expr) | [expr] | {...} | -primary | function
+func (p *parser) primary() (filter, error) {
+	t := p.next()
+	switch t.kind {
+	case tokField:
+		return indexFilter(literalFilter(t.text)), nil
+	case tokString, tokNumber:
+		return literalFilter(t.val), nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literalFilter(true), nil
+		case "false":
+			return literalFilter(false), nil
+		case "null":
+			return literalFilter(nil), nil
+		}
+		return p.function(t)
+	case tokOp:
+		switch t.text {
+		case ".":
+			if p.peek().kind == tokString {
+				return indexFilter(literalFilter(p.next().val)), nil
+			}
+			return identityFilter, nil
+		case "(":
+			f, err := p.pipe()
+			if err != nil {
+				return nil, err
+			}
+			return f, p.expect(")")
+		case "[":
+			if p.isOp("]") {
+				p.next()
+				return literalFilter([]interface{}{}), nil
+			}
+			f, err := p.pipe()
+			if err != nil {
+				return nil, err
+			}
+			return collectFilter(f), p.expect("]")
+		case "{":
+			return p.object()
+		case "-":
+			f, err := p.postfix()
+			if err != nil {
+				return nil, err
+			}
+			return binaryFilter(literalFilter(float64(0)), f, minus), nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", describe(t), t.pos)
+}
+
+// object := '{' (key (':' alt)?) (',' key (':' alt)?)* '}'
+func (p *parser) object() (filter, error) {
+	keys := []filter{}
+	values := []filter{}
+	for !p.isOp("}") {
+		t := p.next()
+		var key filter
+		var value filter
+		switch t.kind {
+		case tokIdent:
+			key = literalFilter(t.text)
+			value = indexFilter(literalFilter(t.text))
+		case tokString:
+			key = literalFilter(t.val)
+			value = indexFilter(literalFilter(t.val))
+		case tokOp:
+			if t.text != "(" {
+				return nil, fmt.Errorf("unexpected %s at %d", describe(t), t.pos)
+			}
+			f, err := p.pipe()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			key = f
+		default:
+			return nil, fmt.Errorf("unexpected %s at %d", describe(t), t.pos)
+		}
+
+		if p.isOp(":") {
+			p.next()
+			f, err := p.alt()
+			if err != nil {
+				return nil, err
+			}
+			value = f
+		}
+		if value == nil {
+			return nil, fmt.Errorf("missing value for key at %d", t.pos)
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+	return objectFilter(keys, values), nil
+}
+
+// function := name | name '(' pipe ')'
+func (p *parser) function(t token) (filter, error) {
+	fn, ok := functions[t.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function: %s at %d", t.text, t.pos)
+	}
+
+	var arg filter
+	if p.isOp("(") {
+		p.next()
+		f, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		arg = f
+	}
+
+	if fn.arg != (arg != nil) {
+		if fn.arg {
+			return nil, fmt.Errorf("function %s takes an argument at %d", t.text, t.pos)
+		}
+		return nil, fmt.Errorf("function %s takes no arguments at %d", t.text, t.pos)
+	}
+
+	return fn.new(arg), nil
+}
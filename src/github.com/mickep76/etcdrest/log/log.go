@@ -22,6 +22,14 @@ func Infof(fmt string, args ...interface{}) {
 	}
 }
 
+func Error(msg string) {
+	log.Print(msg)
+}
+
+func Errorf(fmt string, args ...interface{}) {
+	log.Printf(fmt, args...)
+}
+
 func Fatal(msg string) {
 	log.Fatal(msg)
 }
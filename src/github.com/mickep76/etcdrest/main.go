@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/bgentry/speakeasy"
 	"github.com/codegangsta/cli"
@@ -25,6 +27,10 @@ func main() {
 		cli.StringFlag{Name: "templ-dir", EnvVar: "ETCDREST_TEMPL_DIR", Usage: "Template directory"},
 		cli.StringFlag{Name: "schema-uri", EnvVar: "ETCDREST_SCHEMA_URI", Usage: "Schema URI"},
 		cli.StringFlag{Name: "server-uri", EnvVar: "ETCDREST_SERVER_URI", Usage: "Server URI"},
+		cli.StringFlag{Name: "openapi", EnvVar: "ETCDREST_OPENAPI", Usage: "OpenAPI document endpoint"},
+		cli.StringFlag{Name: "routes-prefix", EnvVar: "ETCDREST_ROUTES_PREFIX", Usage: "etcd prefix with routes to add to the routes of the config file"},
+		cli.StringFlag{Name: "admin-token", EnvVar: "ETCDREST_ADMIN_TOKEN", Usage: "Bearer token for the admin endpoint, it's disabled without a token"},
+		cli.StringFlag{Name: "backend", EnvVar: "ETCDREST_BACKEND", Usage: "Backend either etcd or memory"},
 		cli.StringFlag{Name: "peers, p", EnvVar: "ETCDREST_PEERS", Usage: "Comma-delimited list of hosts in the cluster"},
 		cli.StringFlag{Name: "cert", EnvVar: "ETCDREST_CERT", Usage: "Identify HTTPS client using this SSL certificate file"},
 		cli.StringFlag{Name: "key", EnvVar: "ETCDREST_KEY", Usage: "Identify HTTPS client using this SSL key file"},
@@ -32,6 +38,9 @@ func main() {
 		cli.StringFlag{Name: "user, u", EnvVar: "ETCDREST_USER", Usage: "Username"},
 		cli.DurationFlag{Name: "timeout, t", Usage: "Connection timeout"},
 		cli.DurationFlag{Name: "command-timeout, T", Usage: "Command timeout"},
+		cli.DurationFlag{Name: "reload-interval", Usage: "How often files are checked for changes to reload the config (2s), 0 to only reload on SIGHUP"},
+		cli.IntFlag{Name: "etcd-api-version", EnvVar: "ETCDREST_ETCD_API_VERSION", Usage: "etcd API version (2 or 3)"},
+		cli.IntFlag{Name: "max-txn-ops", Usage: "Most keys written in an etcd v3 transaction, the same as --max-txn-ops of etcd (128)"},
 		cli.StringFlag{Name: "bind, b", EnvVar: "ETCDREST_BIND", Usage: "Bind address"},
 		cli.StringFlag{Name: "api-version, V", EnvVar: "ETCDREST_API_VERSION", Usage: "API Version"},
 		cli.BoolFlag{Name: "envelope", Usage: "Enable default data envelope in a response"},
@@ -41,6 +50,15 @@ func main() {
 	app.Action = func(c *cli.Context) {
 		runServer(c, cfg)
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "check-config",
+			Usage: "Check configuration and report every problem",
+			Action: func(c *cli.Context) {
+				checkConfig(c, cfg)
+			},
+		},
+	}
 
 	app.Run(os.Args)
 }
@@ -51,7 +69,7 @@ func runServer(c *cli.Context, cfg *config.Config) {
 		log.SetDebug()
 	}
 
-	cfg.Load(c)
+	errors := cfg.Load(c)
 
 	// Print configuration.
 	if c.GlobalIsSet("print-config") {
@@ -59,6 +77,11 @@ func runServer(c *cli.Context, cfg *config.Config) {
 		os.Exit(0)
 	}
 
+	// Check configuration.
+	if len(errors) > 0 {
+		log.Fatalf("Invalid configuration:\n%s", errorList(errors))
+	}
+
 	// Create etcd config.
 	ec := etcd.New()
 	ec.Peers(cfg.Etcd.Peers)
@@ -67,9 +90,12 @@ func runServer(c *cli.Context, cfg *config.Config) {
 	ec.CA(cfg.Etcd.CA)
 	ec.Timeout(cfg.Etcd.Timeout)
 	ec.CmdTimeout(cfg.Etcd.CmdTimeout)
+	ec.APIVersion(cfg.Etcd.APIVersion)
+	ec.MaxTxnOps(cfg.Etcd.MaxTxnOps)
+	ec.Backend(cfg.Backend)
 
 	// If user is set ask for password.
-	if cfg.Etcd.User != "" {
+	if cfg.Etcd.User != "" && cfg.Backend == etcd.BackendEtcd {
 		ec.User(cfg.Etcd.User)
 		pass, err := speakeasy.Ask("Password: ")
 		if err != nil {
@@ -84,7 +110,53 @@ func runServer(c *cli.Context, cfg *config.Config) {
 		log.Fatal(err.Error())
 	}
 
+	// Add routes from etcd and check routes.
+	if errors := loadRoutes(cfg, es); len(errors) > 0 {
+		log.Fatalf("Invalid configuration:\n%s", errorList(errors))
+	}
+
 	// Create server config.
+	a := &admin{cfg: cfg, es: es}
+	sc, err := newServer(cfg, es, a)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	a.sc = sc
+
+	// Reload config when it changes.
+	go watchConfig(c, a)
+
+	// Start server.
+	if err := sc.Run(); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// errorList returns errors with one on each line.
+func errorList(errors []error) string {
+	msgs := []string{}
+	for _, err := range errors {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// checkConfig print every problem with the config file, routes in etcd aren't checked.
+func checkConfig(c *cli.Context, cfg *config.Config) {
+	errors := cfg.Load(c)
+	errors = append(errors, cfg.Check()...)
+	for _, err := range errors {
+		fmt.Println(err.Error())
+	}
+
+	if len(errors) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("Configuration is valid.")
+}
+
+// newServer returns a server config with the settings and routes of a config.
+func newServer(cfg *config.Config, es etcd.Session, a server.Admin) (server.Config, error) {
 	sc := server.New(es)
 	sc.TemplDir(cfg.TemplDir)
 	sc.SchemaURI(cfg.SchemaURI)
@@ -92,27 +164,60 @@ func runServer(c *cli.Context, cfg *config.Config) {
 	sc.ServerURI(cfg.ServerURI)
 	sc.Envelope(cfg.Envelope)
 	sc.Indent(cfg.Indent)
+	sc.OpenAPI(cfg.OpenAPI)
+	sc.Version(Version)
+	if cfg.AdminToken != "" {
+		sc.Admin(cfg.AdminToken, a)
+	}
 
 	for _, route := range cfg.Routes {
 		switch route.Type {
 		case "api":
-			sc.RouteEtcd(route.Collection, route.CollectionPath, route.Resource, route.ResourcePath, route.Schema, route.DirName)
+			rt := sc.RouteEtcd(route.Collection, route.CollectionPath, route.Resource, route.ResourcePath, route.Schema, route.DirName)
+			switch route.Storage {
+			case "":
+			case server.StorageTree, server.StorageBlob:
+				rt.Storage(route.Storage)
+			default:
+				return nil, fmt.Errorf("unknown storage: %s for endpoint: %s", route.Storage, route.Resource)
+			}
+			switch route.IDStrategy {
+			case "":
+			case server.IDUUID, server.IDULID, server.IDEtcd:
+				rt.IDStrategy(route.IDStrategy)
+			default:
+				return nil, fmt.Errorf("unknown ID strategy: %s for endpoint: %s", route.IDStrategy, route.Resource)
+			}
+			if len(route.Indexes) > 0 {
+				rt.Indexes(route.Indexes)
+			}
+			if len(route.Unique) > 0 {
+				rt.Unique(route.Unique)
+			}
+			if route.Parent != "" {
+				switch route.OnDelete {
+				case "", server.OnDeleteRestrict, server.OnDeleteCascade:
+					rt.Parent(route.Parent, route.OnDelete)
+				default:
+					return nil, fmt.Errorf("unknown delete policy for parent: %s for endpoint: %s", route.OnDelete, route.Resource)
+				}
+			}
+			for _, ref := range route.References {
+				switch ref.OnDelete {
+				case "", server.OnDeleteRestrict, server.OnDeleteCascade, server.OnDeleteNullify:
+					rt.Reference(ref.Field, ref.Route, ref.OnDelete)
+				default:
+					return nil, fmt.Errorf("unknown delete policy: %s for reference: %s for endpoint: %s", ref.OnDelete, ref.Field, route.Resource)
+				}
+			}
 		case "template":
 			sc.RouteTemplate(route.Endpoint, route.Template)
 		case "static":
 			sc.RouteStatic(route.Endpoint, route.Path)
 		default:
-			log.Fatalf("Unknown type: %s for endpoint: %s", route.Type, route.Endpoint)
+			return nil, fmt.Errorf("unknown type: %s for endpoint: %s", route.Type, route.Endpoint)
 		}
 	}
 
-	// Check routes.
-	if len(cfg.Routes) < 1 {
-		log.Fatal("No routes specified.")
-	}
-
-	// Start server.
-	if err := sc.Run(); err != nil {
-		log.Fatal(err.Error())
-	}
+	return sc, nil
 }
@@ -0,0 +1,20 @@
+// Package pattern reads the variables of the mux patterns of routes.
+package pattern
+
+import (
+	"regexp"
+	"strings"
+)
+
+// VarRegexp matches a variable in a route, the name is the first submatch and
+// the ":" and regexp, if any, the second.
+var VarRegexp = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// Vars returns the names of the variables in a route.
+func Vars(route string) map[string]bool {
+	vars := map[string]bool{}
+	for _, m := range VarRegexp.FindAllStringSubmatch(route, -1) {
+		vars[strings.TrimSpace(m[1])] = true
+	}
+	return vars
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/mickep76/etcdrest/config"
+	"github.com/mickep76/etcdrest/etcd"
+	"github.com/mickep76/etcdrest/log"
+)
+
+// retryInterval is the time before the routes prefix is watched again after an error.
+const retryInterval = 2 * time.Second
+
+// modTime returns the last time a file under the paths was modified.
+func modTime(paths ...string) time.Time {
+	var t time.Time
+	for _, p := range paths {
+		filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.ModTime().After(t) {
+				t = info.ModTime()
+			}
+			return nil
+		})
+	}
+	return t
+}
+
+// watchedPaths returns the config file, template directory and schema directory of a config.
+func watchedPaths(cfg *config.Config) []string {
+	paths := []string{cfg.TemplDir}
+	if cfg.File() != "" {
+		paths = append(paths, cfg.File())
+	}
+	if strings.HasPrefix(cfg.SchemaURI, "file://") {
+		paths = append(paths, strings.TrimPrefix(cfg.SchemaURI, "file://"))
+	}
+	return paths
+}
+
+// loadRoutes add the routes under the routes prefix in etcd to a config, each
+// route is a JSON value named by its key. Returns every problem with the routes.
+func loadRoutes(cfg *config.Config, es etcd.Session) []error {
+	if cfg.RoutesPrefix != "" {
+		doc, _, code, err := es.GetBlob(context.Background(), cfg.RoutesPrefix, false, "")
+		if err != nil && code != http.StatusNotFound {
+			return []error{fmt.Errorf("can't get routes: %s: %s", cfg.RoutesPrefix, err.Error())}
+		}
+
+		if err == nil {
+			routes, ok := doc.(map[string]interface{})
+			if !ok {
+				return []error{fmt.Errorf("routes prefix isn't a directory: %s", cfg.RoutesPrefix)}
+			}
+
+			names := []string{}
+			for n := range routes {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+
+			var errors []error
+			for _, n := range names {
+				b, err := json.Marshal(routes[n])
+				if err != nil {
+					return []error{err}
+				}
+				errors = append(errors, cfg.AddRoute(strings.TrimSuffix(cfg.RoutesPrefix, "/")+"/"+n, b)...)
+			}
+			if len(errors) > 0 {
+				return errors
+			}
+		}
+	}
+
+	return cfg.Check()
+}
+
+// watchRoutes send on changed when a key under the routes prefix changes.
+func watchRoutes(es etcd.Session, prefix string, changed chan<- struct{}) {
+	var index uint64
+	for {
+		w := es.Watch(context.Background(), prefix, index)
+		for {
+			ev, code, err := w.Next()
+			if err != nil {
+				log.Errorf("Failed to watch routes: %s: %s", prefix, err.Error())
+
+				// Events were missed, reload and watch from now.
+				if code == http.StatusGone {
+					index = 0
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+				break
+			}
+
+			index = ev.Index
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+		w.Close()
+		time.Sleep(retryInterval)
+	}
+}
+
+// watchConfig reload the config on SIGHUP or when a watched file changes. If
+// the new config has a problem the running config is kept.
+func watchConfig(c *cli.Context, a *admin) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	a.Lock()
+	prefix, paths, interval := a.cfg.RoutesPrefix, watchedPaths(a.cfg), time.Duration(a.cfg.ReloadInterval)
+	a.Unlock()
+
+	// Files are checked for changes every interval, there is no portable file
+	// notification without another dependency.
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// Changes to the routes prefix need a restart.
+	changed := make(chan struct{}, 1)
+	if prefix != "" {
+		go watchRoutes(a.es, prefix, changed)
+	}
+
+	last := modTime(paths...)
+	for {
+		select {
+		case <-hup:
+			log.Info("Reload config on SIGHUP")
+		case <-changed:
+			log.Info("Reload config, routes in etcd have changed")
+		case <-tick:
+			t := modTime(paths...)
+			if !t.After(last) {
+				continue
+			}
+			last = t
+			log.Info("Reload config, files have changed")
+		}
+
+		next := config.New()
+		errors := next.Load(c)
+		if len(errors) == 0 {
+			next.RoutesPrefix = prefix
+			errors = loadRoutes(next, a.es)
+		}
+		if len(errors) > 0 {
+			log.Errorf("Failed to reload config, keep the previous:\n%s", errorList(errors))
+			continue
+		}
+
+		a.Lock()
+		unsaved := a.unsaved
+		err := a.apply(next)
+		if err == nil {
+			a.unsaved = false
+		}
+		a.Unlock()
+		if err != nil {
+			log.Errorf("Failed to reload config, keep the previous: %s", err.Error())
+			continue
+		}
+		if unsaved {
+			log.Error("Routes changed with the admin API without persist=true were discarded by the reload")
+		}
+
+		// Files no longer watched can't hide changes to the ones that are.
+		if watched := watchedPaths(next); strings.Join(watched, "\n") != strings.Join(paths, "\n") {
+			paths = watched
+			last = modTime(paths...)
+		}
+	}
+}
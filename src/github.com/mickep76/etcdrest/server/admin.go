@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mickep76/etcdrest/log"
+)
+
+// adminEndpoint is the endpoint of the routes of a running server.
+const adminEndpoint = "/_admin/routes"
+
+// Admin interface, changes the routes of a running server. Routes are JSON and
+// identified by their index, the routes have a version that changes with every
+// change. A change is only made if the routes still have the version it's given,
+// an empty version matches any routes. Each change returns the route, the new
+// version, the HTTP status code and the problems with the change.
+type Admin interface {
+	Routes() ([]interface{}, string)
+	AddRoute([]byte, string, bool) (int, interface{}, string, int, []error)
+	UpdateRoute(int, []byte, string, bool) (interface{}, string, int, []error)
+	RemoveRoute(int, string, bool) (interface{}, string, int, []error)
+}
+
+// Admin add endpoint for the routes of a running server, requests must have the token as a bearer token.
+func (c *config) Admin(token string, admin Admin) Config {
+	log.Infof("Add admin endpoint: %s", adminEndpoint)
+
+	h := func(f func(http.ResponseWriter, *http.Request, Admin)) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="etcdrest"`)
+				c.writeError(w, r, fmt.Errorf("unauthorized"), http.StatusUnauthorized)
+				return
+			}
+			f(w, r, admin)
+		}
+	}
+
+	c.router.HandleFunc(adminEndpoint, h(c.getRoutes)).Methods("GET")
+	c.router.HandleFunc(adminEndpoint, h(c.postRoute)).Methods("POST")
+	c.router.HandleFunc(adminEndpoint+"/{index:[0-9]+}", h(c.getRoute)).Methods("GET")
+	c.router.HandleFunc(adminEndpoint+"/{index:[0-9]+}", h(c.putRoute)).Methods("PUT")
+	c.router.HandleFunc(adminEndpoint+"/{index:[0-9]+}", h(c.deleteRoute)).Methods("DELETE")
+	return c
+}
+
+// persist returns true if a change of the routes should be saved to the config file.
+func persist(r *http.Request) bool {
+	return strings.ToLower(r.URL.Query().Get("persist")) == "true"
+}
+
+// routesVersion returns the version of the routes in the If-Match header, a
+// change of a route requires it unless required is false.
+func routesVersion(r *http.Request, required bool) (string, error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" && required {
+		return "", fmt.Errorf("If-Match with the ETag of the routes is required")
+	}
+	if h == "*" {
+		return "", nil
+	}
+	return strings.Trim(strings.TrimPrefix(h, "W/"), "\""), nil
+}
+
+// routeIndex returns the index of the route of a request.
+func routeIndex(r *http.Request) int {
+	i, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
+// routeBody returns the route in the body of a request as JSON.
+func routeBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Body.Close(); err != nil {
+		return nil, err
+	}
+
+	// Convert a YAML or TOML body to JSON.
+	b, _, err := bodyJSON(r.Header.Get("Content-Type"), body)
+	return b, err
+}
+
+// getRoutes write the routes of the server.
+func (c *config) getRoutes(w http.ResponseWriter, r *http.Request, admin Admin) {
+	routes, version := admin.Routes()
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", version))
+	c.write(w, r, routes)
+}
+
+// getRoute write a route of the server.
+func (c *config) getRoute(w http.ResponseWriter, r *http.Request, admin Admin) {
+	routes, version := admin.Routes()
+	i := routeIndex(r)
+	if i < 0 || i >= len(routes) {
+		c.writeError(w, r, fmt.Errorf("route doesn't exist: %s", mux.Vars(r)["index"]), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", version))
+	c.write(w, r, routes[i])
+}
+
+// postRoute add a route to the server.
+func (c *config) postRoute(w http.ResponseWriter, r *http.Request, admin Admin) {
+	b, err := routeBody(r)
+	if err != nil {
+		c.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	version, _ := routesVersion(r, false)
+	i, route, version, code, errors := admin.AddRoute(b, version, persist(r))
+	if errors != nil {
+		c.writeErrors(w, r, errors, code)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", version))
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%d", c.serverURI, adminEndpoint, i))
+	c.writeCode(w, r, route, http.StatusCreated)
+}
+
+// putRoute replace a route of the server, the index of a route changes when
+// another route is removed so If-Match must have the version of the routes.
+func (c *config) putRoute(w http.ResponseWriter, r *http.Request, admin Admin) {
+	version, err := routesVersion(r, true)
+	if err != nil {
+		c.writeError(w, r, err, http.StatusPreconditionRequired)
+		return
+	}
+
+	b, err := routeBody(r)
+	if err != nil {
+		c.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	route, version, code, errors := admin.UpdateRoute(routeIndex(r), b, version, persist(r))
+	if errors != nil {
+		c.writeErrors(w, r, errors, code)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", version))
+	c.write(w, r, route)
+}
+
+// deleteRoute remove a route from the server, If-Match must have the version of the routes.
+func (c *config) deleteRoute(w http.ResponseWriter, r *http.Request, admin Admin) {
+	version, err := routesVersion(r, true)
+	if err != nil {
+		c.writeError(w, r, err, http.StatusPreconditionRequired)
+		return
+	}
+
+	route, version, code, errors := admin.RemoveRoute(routeIndex(r), version, persist(r))
+	if errors != nil {
+		c.writeErrors(w, r, errors, code)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", version))
+	c.write(w, r, route)
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mickep76/etcdrest/etcd"
+	"github.com/mickep76/etcdrest/log"
+)
+
+// backfillPrefix is the etcd path where the keys declared by each route are
+// recorded once the keys of its existing documents have been added.
+const backfillPrefix = "/_etcdrest/backfill"
+
+// segmentRegexp matches a segment of a path template that is a single variable.
+var segmentRegexp = regexp.MustCompile(`^\{\{\s*\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}$`)
+
+// backfillMarker returns the etcd path recording the keys added for a route.
+func backfillMarker(rt *route) string {
+	return backfillPrefix + "/" + url.PathEscape(rt.resourcePath)
+}
+
+// backfilled returns true if the keys of a kind declared for a field have
+// been added for every document of a route.
+func (c *config) backfilled(ctx context.Context, rt *route, kind, field string) (bool, int, error) {
+	d, _, code, err := c.session.GetBlob(ctx, backfillMarker(rt), false, "")
+	if code == http.StatusNotFound {
+		return false, http.StatusOK, nil
+	}
+	if err != nil {
+		return false, code, err
+	}
+
+	m, _ := d.(map[string]interface{})
+	l, _ := m[kind].([]interface{})
+	for _, v := range l {
+		if v == field {
+			return true, http.StatusOK, nil
+		}
+	}
+	return false, http.StatusOK, nil
+}
+
+// declared returns the indexes, unique values and references declared by a route.
+func (rt *route) declared() map[string][]string {
+	refs := []string{}
+	for _, ref := range rt.references {
+		refs = append(refs, ref.field+"="+ref.route)
+	}
+
+	m := map[string][]string{
+		"indexes":    append([]string{}, rt.indexes...),
+		"unique":     append([]string{}, rt.unique...),
+		"references": refs,
+	}
+	for _, l := range m {
+		sort.Strings(l)
+	}
+	return m
+}
+
+// expand returns the paths of a path template and their variables by listing
+// the directory of each variable.
+func (c *config) expand(ctx context.Context, tmpl string) ([]nestedDoc, error) {
+	paths := []nestedDoc{{vars: map[string]string{}}}
+	for _, seg := range strings.Split(strings.TrimPrefix(tmpl, "/"), "/") {
+		next := []nestedDoc{}
+		for _, p := range paths {
+			m := segmentRegexp.FindStringSubmatch(seg)
+			if m == nil {
+				if strings.Contains(seg, "{{") {
+					return nil, fmt.Errorf("can't list paths of template: %s", tmpl)
+				}
+				next = append(next, nestedDoc{path: p.path + "/" + seg, vars: p.vars})
+				continue
+			}
+
+			dir := p.path
+			if dir == "" {
+				dir = "/"
+			}
+			names, code, err := c.session.List(ctx, dir)
+			if code == http.StatusNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range names {
+				next = append(next, nestedDoc{path: p.path + "/" + n, vars: withVar(p.vars, m[1], n)})
+			}
+		}
+		paths = next
+	}
+	return paths, nil
+}
+
+// documents returns every document of a route.
+func (c *config) documents(ctx context.Context, rt *route) ([]nestedDoc, error) {
+	tmpl := rt.collectionPath
+	if rt.idVar == "" {
+		tmpl = rt.resourcePath
+	}
+
+	paths, err := c.expand(ctx, tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []nestedDoc{}
+	for _, p := range paths {
+		vars := []map[string]string{p.vars}
+		if rt.idVar != "" {
+			names, code, err := c.session.List(ctx, p.path)
+			if code == http.StatusNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			vars = nil
+			for _, n := range names {
+				vars = append(vars, withVar(p.vars, rt.idVar, n))
+			}
+		}
+
+		for _, v := range vars {
+			path := c.render(rt.resource, v)
+			doc, _, code, err := c.get(ctx, rt, path, false)
+			if code == http.StatusNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, nestedDoc{rt: rt, vars: v, path: path, doc: doc})
+		}
+	}
+	return docs, nil
+}
+
+// backfill add the index and reference keys and claim the unique values of
+// documents written before they were declared by their route. A route is only
+// backfilled once for the keys it declares, unless a value is claimed twice,
+// then the unique values are left out of the marker and checked again.
+func (c *config) backfill() error {
+	ctx := context.Background()
+
+	names := []string{}
+	for n, rt := range c.routes {
+		if rt.keyed() {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		rt := c.routes[n]
+		marker := backfillMarker(rt)
+		want, _ := json.Marshal(rt.declared())
+
+		d, _, code, err := c.session.GetBlob(ctx, marker, false, "")
+		if err == nil {
+			if b, _ := json.Marshal(d); string(b) == string(want) {
+				continue
+			}
+		} else if code != http.StatusNotFound {
+			return err
+		}
+
+		log.Infof("Add keys of existing documents: %s", rt.resource)
+		docs, err := c.documents(ctx, rt)
+		if err != nil {
+			return fmt.Errorf("%s: %s", rt.resource, err.Error())
+		}
+
+		conflicts := 0
+		for _, d := range docs {
+			keys, claims := c.ownKeys(rt, d.vars, d.path, d.doc)
+			_, err := c.session.PutKeys(ctx, &etcd.PutOptions{SetKeys: keys, ClaimKeys: claims})
+			if _, ok := err.(*etcd.ClaimError); ok {
+				log.Errorf("Existing document breaks unique constraint: %s: %s", d.path, c.conflict(err).Error())
+				conflicts++
+
+				// Index and reference keys don't depend on the claims.
+				_, err = c.session.PutKeys(ctx, &etcd.PutOptions{SetKeys: keys})
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", d.path, err.Error())
+			}
+		}
+
+		done := rt.declared()
+		if conflicts > 0 {
+			done["unique"] = []string{}
+		}
+		b, _ := json.Marshal(done)
+		if _, err := c.session.PutBlob(ctx, marker, b, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
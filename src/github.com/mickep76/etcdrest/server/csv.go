@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mickep76/etcdrest/etcd"
+)
+
+// mimeCSV is the content type of CSV.
+const mimeCSV = "text/csv"
+
+// maxImportSize is the largest CSV accepted for an import.
+const maxImportSize = 10 << 20
+
+// maxDepth is how deep nested properties of a schema are flattened.
+const maxDepth = 8
+
+// importResult is the result of importing a row, written is set once the
+// resource of the row has been written.
+type importResult struct {
+	Row     int      `json:"row"`
+	Name    string   `json:"name,omitempty"`
+	Code    int      `json:"code"`
+	Written bool     `json:"written"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// columns returns the columns of a table, the name of each resource followed
+// by the properties of the schema of the route with nested objects flattened.
+func (c *config) columns(rt *route, dirName string) ([]string, error) {
+	s, err := c.schemaFile(rt.schema)
+	if err != nil {
+		return nil, err
+	}
+
+	cols, err := c.properties(rt.schema, s, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{dirName}, cols...), nil
+}
+
+// properties returns the dotted names of the properties of a schema.
+func (c *config) properties(file string, s map[string]interface{}, prefix string, depth int) ([]string, error) {
+	file, s, err := c.resolve(file, s)
+	if err != nil {
+		return nil, err
+	}
+
+	props, _ := s["properties"].(map[string]interface{})
+	names := []string{}
+	for n := range props {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	cols := []string{}
+	for _, n := range names {
+		p, _ := props[n].(map[string]interface{})
+		pf, ps, err := c.resolve(file, p)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := ps["properties"]; ok && depth < maxDepth {
+			l, err := c.properties(pf, ps, prefix+n+".", depth+1)
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, l...)
+			continue
+		}
+		cols = append(cols, prefix+n)
+	}
+	return cols, nil
+}
+
+// propertyType returns the type of a dotted property in a schema, or "" if
+// it has none.
+func (c *config) propertyType(file string, s map[string]interface{}, path []string) (string, error) {
+	file, s, err := c.resolve(file, s)
+	if err != nil {
+		return "", err
+	}
+
+	if len(path) == 0 {
+		switch t := s["type"].(type) {
+		case string:
+			return t, nil
+		case []interface{}:
+			for _, e := range t {
+				if e, ok := e.(string); ok && e != "null" {
+					return e, nil
+				}
+			}
+		}
+		return "", nil
+	}
+
+	// Property is matched by name, by pattern or as an additional property.
+	if props, ok := s["properties"].(map[string]interface{}); ok {
+		if p, ok := props[path[0]].(map[string]interface{}); ok {
+			return c.propertyType(file, p, path[1:])
+		}
+	}
+	if props, ok := s["patternProperties"].(map[string]interface{}); ok {
+		for pattern, p := range props {
+			if m, err := regexp.MatchString(pattern, path[0]); err == nil && m {
+				if p, ok := p.(map[string]interface{}); ok {
+					return c.propertyType(file, p, path[1:])
+				}
+			}
+		}
+	}
+	if p, ok := s["additionalProperties"].(map[string]interface{}); ok {
+		return c.propertyType(file, p, path[1:])
+	}
+	return "", nil
+}
+
+// cell returns a value as a CSV cell, objects and arrays are written as JSON.
+func cell(v interface{}) string {
+	switch e := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return e
+	case float64:
+		return strconv.FormatFloat(e, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(e)
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// cellValue returns the value of a CSV cell as a property type.
+func cellValue(t, s string) interface{} {
+	switch t {
+	case "integer", "number":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case "object", "array":
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err == nil {
+			return v
+		}
+	}
+	return s
+}
+
+// setField set a nested field of a document, creating the objects on the way.
+func setField(doc map[string]interface{}, path []string, v interface{}) {
+	for _, k := range path[:len(path)-1] {
+		m, ok := doc[k].(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{}
+			doc[k] = m
+		}
+		doc = m
+	}
+	doc[path[len(path)-1]] = v
+}
+
+// writeTable write a table as CSV if the request asks for it, otherwise the same as writeMeta.
+func (c *config) writeTable(w http.ResponseWriter, r *http.Request, rt *route, data interface{}, code int, meta map[string]interface{}) {
+	rows, ok := data.([]interface{})
+	if !ok || responseFormat(r) != formatCSV {
+		c.writeMeta(w, r, data, code, meta)
+		return
+	}
+
+	dirName := rt.dirName
+	if dirName == "" {
+		dirName = "dir"
+	}
+
+	cols, err := c.columns(rt, dirName)
+	if err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	var b bytes.Buffer
+	cw := csv.NewWriter(&b)
+	cw.Write(cols)
+	for _, row := range rows {
+		rec := make([]string, len(cols))
+		for i, col := range cols {
+			if v, ok := field(row, col); ok {
+				rec[i] = cell(v)
+			}
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+
+	w.Header().Set("Content-Type", mimeCSV+"; charset=utf-8")
+	varyAccept(w)
+	w.WriteHeader(code)
+	w.Write(b.Bytes())
+}
+
+// importCSV create or replace a resource for each row of a CSV, the columns
+// are the same as for a table. Nothing is written unless every row is valid.
+func (c *config) importCSV(w http.ResponseWriter, r *http.Request, rt *route) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxImportSize))
+	if err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		c.writeError(w, r, fmt.Errorf("invalid CSV: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if len(records) < 1 {
+		c.writeError(w, r, fmt.Errorf("invalid CSV: missing header"), http.StatusBadRequest)
+		return
+	}
+	header := records[0]
+
+	dirName := rt.dirName
+	if dirName == "" {
+		dirName = "dir"
+	}
+
+	s, err := c.schemaFile(rt.schema)
+	if err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	types := map[string]string{}
+	for _, col := range header {
+		if types[col], err = c.propertyType(rt.schema, s, strings.Split(col, ".")); err != nil {
+			c.writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Validate every row before anything is written.
+	type row struct {
+		name string
+		doc  []byte
+		data interface{}
+	}
+	rows := []row{}
+	results := []importResult{}
+	names := map[string]int{}
+	invalid := false
+	for i, rec := range records[1:] {
+		res := importResult{Row: i + 1, Code: http.StatusOK}
+		data := map[string]interface{}{}
+		for j, col := range header {
+			switch {
+			case rec[j] == "":
+			case col == dirName:
+				res.Name = rec[j]
+			default:
+				setField(data, strings.Split(col, "."), cellValue(types[col], rec[j]))
+			}
+		}
+
+		// The name must be a valid ID so the resource stays inside the collection,
+		// and can only be used once or one row would replace the other.
+		if res.Name != "" {
+			err := rt.checkID(res.Name)
+			if j, ok := names[res.Name]; ok && err == nil {
+				err = fmt.Errorf("%s is the same as for row %d: %s", dirName, j, res.Name)
+			}
+			if err != nil {
+				res.Code, res.Errors = http.StatusBadRequest, []string{err.Error()}
+				invalid = true
+				rows = append(rows, row{})
+				results = append(results, res)
+				continue
+			}
+			names[res.Name] = res.Row
+		}
+
+		if _, err := c.fillDefaults(rt.schema, s, data); err != nil {
+			c.writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		doc, err := json.Marshal(data)
+		if err != nil {
+			c.writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		if code, errors := c.validateDoc(doc, fmt.Sprintf("row %d", res.Row), rt.schema); errors != nil {
+			res.Code = code
+			for _, e := range errors {
+				res.Errors = append(res.Errors, e.Error())
+			}
+			invalid = true
+		}
+
+		rows = append(rows, row{name: res.Name, doc: doc, data: data})
+		results = append(results, res)
+	}
+
+	if invalid {
+		c.writeCode(w, r, results, http.StatusUnprocessableEntity)
+		return
+	}
+
+	status := http.StatusOK
+	for i, row := range rows {
+		res := &results[i]
+
+		// Rows without a name get a server-generated ID.
+		collPath := c.render(rt.collection, mux.Vars(r))
+		if row.name == "" {
+			id, code, err := c.newID(r.Context(), rt, collPath)
+			if err != nil {
+				res.Code, res.Errors = code, []string{err.Error()}
+				status = http.StatusUnprocessableEntity
+				continue
+			}
+			res.Name = id
+		}
+
+		vars := withVar(copyVars(r), rt.idVar, res.Name)
+		written, code, err := c.replace(r.Context(), rt, vars, c.render(rt.resource, vars), row.doc, row.data)
+		res.Written = written
+		if err != nil {
+			res.Code, res.Errors = code, []string{err.Error()}
+			status = http.StatusUnprocessableEntity
+
+			// A write that timed out may still have been made.
+			if row.name == "" && !written && code != http.StatusGatewayTimeout {
+				c.dropID(r.Context(), rt, collPath, res.Name)
+			}
+		}
+	}
+
+	c.writeCode(w, r, results, status)
+}
+
+// replace create or replace a document, keys outside the document are
+// updated in the same write. Returns true if the document was written, even
+// if updating the resources depending on it failed.
+func (c *config) replace(ctx context.Context, rt *route, vars map[string]string, path string, doc []byte, data interface{}) (bool, int, error) {
+	if code, err := c.checkReferences(ctx, rt, vars, data); err != nil {
+		return false, code, err
+	}
+
+	for retry := 0; ; retry++ {
+		opts := &etcd.PutOptions{}
+		var removed []nestedDoc
+		if c.keyed(rt) || c.nests(rt) {
+			old, index, code, err := c.get(ctx, rt, path, false)
+			switch {
+			case code == http.StatusNotFound:
+				opts.PrevNoExist = true
+				old = nil
+			case err != nil:
+				return false, code, err
+			default:
+				opts.PrevIndex = index
+			}
+
+			// The policies of the resources depending on what's removed are applied once the document is written.
+			if removed = c.removed(rt, vars, path, old, data); len(removed) > 0 {
+				if code, err := c.dropNested(ctx, removed, true); err != nil {
+					return false, code, err
+				}
+			}
+			if err := c.putKeys(rt, vars, path, old, data, opts); err != nil {
+				return false, http.StatusConflict, err
+			}
+		}
+
+		var code int
+		var err error
+		if rt.storage == StorageBlob {
+			code, err = c.session.PutBlob(ctx, path, doc, opts)
+		} else {
+			code, err = c.session.Put(ctx, path, data, opts)
+		}
+		if code == http.StatusPreconditionFailed && (c.keyed(rt) || c.nests(rt)) && retry < maxRetries {
+			continue
+		}
+		if err != nil {
+			return false, code, c.conflict(err)
+		}
+
+		if len(removed) > 0 {
+			if code, err := c.dropNested(ctx, removed, false); err != nil {
+				return true, code, fmt.Errorf("document written, but the resources depending on what was removed from it weren't updated: %s", err.Error())
+			}
+		}
+		return true, code, nil
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestImportCSV(t *testing.T) {
+	ts := newTestServer(t)
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{}`)
+	expect(t, ts, http.StatusOK, "PUT", "/api/hosts/x", `{"site": "sto1", "serial": "9"}`)
+
+	for _, tc := range []struct {
+		name, csv string
+		code      int
+		written   []bool
+	}{
+		{"invalid row", "host,site,serial\na,sto1,1\nb,,2\n", http.StatusUnprocessableEntity, []bool{false, false}},
+		{"invalid name", "host,site,serial\na,sto1,1\n..,sto1,2\n", http.StatusUnprocessableEntity, []bool{false, false}},
+		{"duplicate name", "host,site,serial\na,sto1,1\na,sto1,2\n", http.StatusUnprocessableEntity, []bool{false, false}},
+		{"failed write", "host,site,serial\na,sto1,1\nb,sto1,9\nc,sto1,3\n", http.StatusUnprocessableEntity, []bool{true, false, true}},
+		{"generated name", "host,site,serial\n,sto1,4\n", http.StatusOK, []bool{true}},
+	} {
+		res, b := do(t, ts, "POST", "/api/hosts", tc.csv, "Content-Type", "text/csv")
+		if res.StatusCode != tc.code {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, res.StatusCode, tc.code, b)
+			continue
+		}
+
+		results := decodeBody(t, b).([]interface{})
+		if len(results) != len(tc.written) {
+			t.Errorf("%s: got %d results, want %d: %s", tc.name, len(results), len(tc.written), b)
+			continue
+		}
+		for i, r := range results {
+			if written := r.(map[string]interface{})["written"]; written != tc.written[i] {
+				t.Errorf("%s: row %d written is %v, want %v: %s", tc.name, i+1, written, tc.written[i], b)
+			}
+		}
+	}
+
+	// Only the rows that were written are in the table.
+	_, b := expect(t, ts, http.StatusOK, "GET", "/api/hosts?table=true&format=csv", "")
+	lines := strings.Split(strings.TrimSpace(b), "\n")
+	if len(lines) != 5 || lines[0] != "host,serial,site" {
+		t.Errorf("table is:\n%s", b)
+	}
+}
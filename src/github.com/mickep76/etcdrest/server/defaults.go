@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+// withDefaults returns a document with the defaults of the schema filled in
+// for missing properties, including properties of nested objects and arrays.
+func (c *config) withDefaults(doc []byte, schema string) ([]byte, error) {
+	var data interface{}
+	if err := json.Unmarshal(doc, &data); err != nil {
+		// Invalid documents are reported by validation.
+		return doc, nil
+	}
+
+	s, err := c.schemaFile(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := c.fillDefaults(schema, s, data)
+	if err != nil || !changed {
+		return doc, err
+	}
+	return json.Marshal(data)
+}
+
+// fillDefaults set the defaults of a schema in a value, returns true if the value was changed.
+func (c *config) fillDefaults(file string, s map[string]interface{}, data interface{}) (bool, error) {
+	file, s, err := c.resolve(file, s)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	fill := func(p interface{}, v interface{}) error {
+		ps, ok := p.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		ch, err := c.fillDefaults(file, ps, v)
+		changed = changed || ch
+		return err
+	}
+
+	if l, ok := s["allOf"].([]interface{}); ok {
+		for _, p := range l {
+			if err := fill(p, data); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	switch v := data.(type) {
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		for n, p := range props {
+			if _, ok := v[n]; !ok {
+				def, err := c.schemaDefault(file, p)
+				if err != nil {
+					return false, err
+				}
+				if def == nil {
+					continue
+				}
+				v[n] = def
+				changed = true
+			}
+			if err := fill(p, v[n]); err != nil {
+				return false, err
+			}
+		}
+
+		// Properties without a schema of their own use the matching pattern or additional properties.
+		patterns, _ := s["patternProperties"].(map[string]interface{})
+		for k, e := range v {
+			if _, ok := props[k]; ok {
+				continue
+			}
+
+			matched := false
+			for pattern, p := range patterns {
+				if m, err := regexp.MatchString(pattern, k); err == nil && m {
+					matched = true
+					if err := fill(p, e); err != nil {
+						return false, err
+					}
+				}
+			}
+			if !matched {
+				if err := fill(s["additionalProperties"], e); err != nil {
+					return false, err
+				}
+			}
+		}
+	case []interface{}:
+		switch items := s["items"].(type) {
+		case map[string]interface{}:
+			for _, e := range v {
+				if err := fill(items, e); err != nil {
+					return false, err
+				}
+			}
+		case []interface{}:
+			for i, e := range v {
+				if i < len(items) {
+					if err := fill(items[i], e); err != nil {
+						return false, err
+					}
+				}
+			}
+		}
+	}
+	return changed, nil
+}
+
+// schemaDefault returns a copy of the default of a schema, or nil if it has none.
+func (c *config) schemaDefault(file string, p interface{}) (interface{}, error) {
+	ps, ok := p.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	// A default next to a $ref is used before the default of the referenced schema.
+	def, ok := ps["default"]
+	if !ok {
+		_, rs, err := c.resolve(file, ps)
+		if err != nil {
+			return nil, err
+		}
+		def = rs["default"]
+	}
+	if def == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWithDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcdrest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for n, s := range map[string]string{
+		"doc.json": `{
+  "type": "object",
+  "allOf": [{"properties": {"owner": {"default": "ops"}}}],
+  "properties": {
+    "state": {"type": "string", "default": "new"},
+    "tags": {"type": "array", "default": []},
+    "address": {"type": "object", "properties": {"country": {"default": "se"}}},
+    "interfaces": {"type": "array", "items": {"$ref": "interface.json"}},
+    "port": {"$ref": "interface.json#/properties/mtu", "default": 22}
+  },
+  "patternProperties": {"^x-": {"type": "object", "properties": {"on": {"default": true}}}},
+  "additionalProperties": {"type": "object", "properties": {"extra": {"default": 1}}}
+}`,
+		"interface.json": `{"type": "object", "properties": {"mtu": {"type": "integer", "default": 1500}}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := New(nil).SchemaURI("file://" + dir).(*config)
+
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`{}`, `{"state": "new", "tags": [], "owner": "ops", "port": 22}`},
+		{`{"state": "done", "tags": ["a"], "owner": null, "port": 80}`, `{"state": "done", "tags": ["a"], "owner": null, "port": 80}`},
+		{`{"address": {}}`, `{"state": "new", "tags": [], "owner": "ops", "port": 22, "address": {"country": "se"}}`},
+		{`{"interfaces": [{}, {"mtu": 9000}]}`, `{"state": "new", "tags": [], "owner": "ops", "port": 22, "interfaces": [{"mtu": 1500}, {"mtu": 9000}]}`},
+		{`{"x-a": {}, "b": {}}`, `{"state": "new", "tags": [], "owner": "ops", "port": 22, "x-a": {"on": true}, "b": {"extra": 1}}`},
+		{`[1]`, `[1]`},
+		{`invalid`, `invalid`},
+	}
+
+	for _, tc := range tests {
+		b, err := c.withDefaults([]byte(tc.doc), "doc.json")
+		if err != nil {
+			t.Errorf("%s: %s", tc.doc, err.Error())
+			continue
+		}
+
+		var got, want interface{}
+		if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+			if string(b) != tc.want {
+				t.Errorf("%s: got %s, want %s", tc.doc, b, tc.want)
+			}
+			continue
+		}
+		if err := json.Unmarshal(b, &got); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %s, want %s", tc.doc, b, tc.want)
+		}
+	}
+
+	if _, err := c.withDefaults([]byte(`{}`), "missing.json"); err == nil {
+		t.Errorf("missing schema: no error")
+	}
+}
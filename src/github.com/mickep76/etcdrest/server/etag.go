@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag returns the entity tag for an etcd index.
+func etag(index uint64) string {
+	return fmt.Sprintf("\"%d\"", index)
+}
+
+// parseETag returns the etcd index of an entity tag.
+func parseETag(tag string) (uint64, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	index, err := strconv.ParseUint(strings.Trim(s, "\""), 10, 64)
+	if err != nil || index == 0 {
+		return 0, fmt.Errorf("invalid entity tag: %s", tag)
+	}
+	return index, nil
+}
+
+// ifMatch returns the index required by the If-Match header, "*" only
+// requires the document to exist.
+func ifMatch(r *http.Request) (uint64, bool, error) {
+	h := r.Header.Get("If-Match")
+	switch h {
+	case "":
+		return 0, false, nil
+	case "*":
+		return 0, true, nil
+	}
+
+	index, err := parseETag(h)
+	if err != nil {
+		return 0, false, err
+	}
+	return index, false, nil
+}
+
+// ifNoneMatch returns true if the If-None-Match header matches the index.
+func ifNoneMatch(r *http.Request, index uint64) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(tag) == "*" {
+			return true
+		}
+		if i, err := parseETag(tag); err == nil && i == index {
+			return true
+		}
+	}
+	return false
+}
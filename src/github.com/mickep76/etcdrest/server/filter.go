@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// reservedParams are query parameters that are not used as filters.
+var reservedParams = map[string]bool{
+	"table":      true,
+	"envelope":   true,
+	"indent":     true,
+	"format":     true,
+	"watch":      true,
+	"index":      true,
+	"indexField": true,
+	"limit":      true,
+	"offset":     true,
+	"cursor":     true,
+	"sort":       true,
+	"q":          true,
+	"value":      true,
+	"dryRun":     true,
+}
+
+// filters returns the query parameters used to filter a collection, a field
+// must be equal to one of the values.
+func filters(r *http.Request) map[string][]string {
+	fs := map[string][]string{}
+	for k, v := range r.URL.Query() {
+		if !reservedParams[k] {
+			fs[k] = v
+		}
+	}
+	return fs
+}
+
+// valueString returns a scalar value as a string the way it would be written in a query.
+func valueString(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case nil:
+		return "null", true
+	case string:
+		return x, true
+	case bool:
+		return strconv.FormatBool(x), true
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// match returns true if a document matches every filter, the directory name
+// field matches the name of the resource.
+func match(doc interface{}, name, dirName string, fs map[string][]string) bool {
+	for k, values := range fs {
+		var v interface{} = name
+		if k != dirName {
+			var ok bool
+			if v, ok = field(doc, k); !ok {
+				return false
+			}
+		}
+
+		s, ok := valueString(v)
+		if !ok {
+			return false
+		}
+
+		found := false
+		for _, e := range values {
+			if s == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
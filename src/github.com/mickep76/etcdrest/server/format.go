@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kezhuw/toml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/mickep76/etcdrest/convert"
+)
+
+// Formats for request and response bodies.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+	formatCSV  = "csv"
+)
+
+// mimeTypes maps media types to formats.
+var mimeTypes = map[string]string{
+	"application/json":   formatJSON,
+	"application/yaml":   formatYAML,
+	"application/x-yaml": formatYAML,
+	"text/yaml":          formatYAML,
+	"text/x-yaml":        formatYAML,
+	"application/toml":   formatTOML,
+	"text/toml":          formatTOML,
+	mimeCSV:              formatCSV,
+}
+
+// contentTypes maps formats to the content type of a response.
+var contentTypes = map[string]string{
+	formatJSON: "application/json; charset=utf-8",
+	formatYAML: "application/yaml; charset=utf-8",
+	formatTOML: "application/toml; charset=utf-8",
+}
+
+// varyAccept tell caches that the response depends on the Accept header.
+func varyAccept(w http.ResponseWriter) {
+	for _, v := range w.Header()["Vary"] {
+		for _, h := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(h), "Accept") {
+				return
+			}
+		}
+	}
+	w.Header().Add("Vary", "Accept")
+}
+
+// responseFormat returns the format of the response using the format parameter
+// or the Accept header, JSON if neither asks for a supported format.
+func responseFormat(r *http.Request) string {
+	switch f := strings.ToLower(r.URL.Query().Get("format")); f {
+	case formatJSON, formatYAML, formatTOML, formatCSV:
+		return f
+	}
+
+	// The supported format with the highest quality wins.
+	format, best := formatJSON, 0.0
+	for _, s := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		f, ok := mimeTypes[t]
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > best {
+			format, best = f, q
+		}
+	}
+	return format
+}
+
+// marshal data in a format.
+func marshal(format string, data interface{}, indent bool) ([]byte, error) {
+	switch format {
+	case formatYAML:
+		return yaml.Marshal(data)
+	case formatTOML:
+		// TOML documents are always a table.
+		v, err := tomlValue(data)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{"data": v}
+		}
+		return toml.Marshal(m)
+	}
+
+	if indent == false {
+		return json.Marshal(data)
+	}
+	return json.MarshalIndent(data, "", "  ")
+}
+
+// tomlValue returns data with whole numbers as integers and without null
+// values, which TOML doesn't have. A null in an array can't be left out
+// without moving the elements after it, so it's an error.
+func tomlValue(data interface{}) (interface{}, error) {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			if e == nil {
+				continue
+			}
+			te, err := tomlValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = te
+		}
+		return m, nil
+	case []interface{}:
+		l := []interface{}{}
+		for i, e := range v {
+			if e == nil {
+				return nil, fmt.Errorf("TOML has no null, array has null at index: %d", i)
+			}
+			te, err := tomlValue(e)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, te)
+		}
+		return l, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), nil
+		}
+	}
+	return data, nil
+}
+
+// bodyJSON converts a YAML or TOML request body to JSON, other bodies are
+// returned as is. The content type to patch with is returned, a YAML or TOML
+// object is a JSON merge patch and a YAML array is a JSON patch.
+func bodyJSON(contentType string, body []byte) ([]byte, string, error) {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, contentType, nil
+	}
+
+	var data interface{}
+	switch mimeTypes[t] {
+	case formatYAML:
+		if err := yaml.Unmarshal(body, &data); err != nil {
+			return nil, "", fmt.Errorf("invalid YAML: %s", err.Error())
+		}
+		data = convert.YAMLValue(data)
+	case formatTOML:
+		m := map[string]interface{}{}
+		if err := toml.Unmarshal(body, &m); err != nil {
+			return nil, "", fmt.Errorf("invalid TOML: %s", err.Error())
+		}
+		data = m
+	default:
+		return body, contentType, nil
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, ok := data.([]interface{}); ok {
+		return b, "application/json-patch+json", nil
+	}
+	return b, mimeMergePatch, nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMarshalTOML(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+		err   bool
+	}{
+		{input: `{"a": 1, "b": 1.5, "c": "x"}`, want: []string{"a = 1", "b = 1.5", `c = "x"`}},
+		{input: `{"a": null, "b": true}`, want: []string{"b = true"}},
+		{input: `{"a": {"b": [1, 2]}}`, want: []string{"[a]", "b = [ 1, 2 ]"}},
+		{input: `[1, 2]`, want: []string{"data = [ 1, 2 ]"}},
+		{input: `{"a": [1, null, 3]}`, err: true},
+		{input: `{"a": [{"b": [null]}]}`, err: true},
+	}
+
+	for _, tc := range tests {
+		var data interface{}
+		if err := json.Unmarshal([]byte(tc.input), &data); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := marshal(formatTOML, data, false)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: no error, got:\n%s", tc.input, b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.input, err.Error())
+			continue
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(string(b), w) {
+				t.Errorf("%s: missing %q in:\n%s", tc.input, w, b)
+			}
+		}
+	}
+}
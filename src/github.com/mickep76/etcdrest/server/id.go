@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mickep76/etcdrest/log"
+	"github.com/mickep76/etcdrest/pattern"
+)
+
+// ID strategies for resources created with POST.
+const (
+	IDUUID = "uuid"
+	IDULID = "ulid"
+	IDEtcd = "etcd"
+)
+
+// idVar returns the variable of the resource route that isn't part of the
+// collection route, or "" if there is none.
+func idVar(collection, resource string) string {
+	vars := pattern.Vars(collection)
+
+	id := ""
+	for _, m := range pattern.VarRegexp.FindAllStringSubmatch(resource, -1) {
+		if v := strings.TrimSpace(m[1]); !vars[v] {
+			id = v
+		}
+	}
+	return id
+}
+
+// checkID returns an error if a name can't be the ID of a resource of the
+// route, it must match the pattern of the variable in the route, by default
+// anything without a "/", and can't be "." or "..".
+func (rt *route) checkID(name string) error {
+	expr := "[^/]+"
+	for _, m := range pattern.VarRegexp.FindAllStringSubmatch(rt.resource, -1) {
+		if strings.TrimSpace(m[1]) == rt.idVar && m[2] != "" {
+			expr = strings.TrimSpace(m[2][1:])
+		}
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return err
+	}
+	if !re.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid %s: %s", rt.idVar, name)
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// crockford is the base32 alphabet used by ULID.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID, a 48 bit timestamp in milliseconds followed by 80
+// random bits, so IDs sort in the order they were created.
+func newULID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+
+	// Encode 128 bits as 26 characters, 5 bits at a time starting with the 2 padding bits.
+	s := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		bit := 128 - (25-i)*5 - 5
+		var v byte
+		for j := 0; j < 5; j++ {
+			if k := bit + j; k >= 0 && b[k/8]&(0x80>>uint(k%8)) != 0 {
+				v |= 0x10 >> uint(j)
+			}
+		}
+		s[i] = crockford[v]
+	}
+
+	return string(s), nil
+}
+
+// newID returns a new ID for a resource in a collection using the ID strategy of the route.
+func (c *config) newID(ctx context.Context, rt *route, collectionPath string) (string, int, error) {
+	var id string
+	var err error
+	switch rt.idStrategy {
+	case IDEtcd:
+		return c.session.CreateInOrder(ctx, collectionPath)
+	case IDULID:
+		id, err = newULID()
+	default:
+		id, err = newUUID()
+	}
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	return id, http.StatusOK, nil
+}
+
+// dropID remove the empty in-order key created for an ID by newID, when the
+// resource it was created for isn't written.
+func (c *config) dropID(ctx context.Context, rt *route, collectionPath, id string) {
+	if rt.idStrategy != IDEtcd {
+		return
+	}
+
+	p := collectionPath + "/" + id
+	if _, err := c.session.Delete(ctx, p, nil); err != nil {
+		log.Infof("Failed to remove unused ID: %s: %s", p, err.Error())
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mickep76/etcdrest/etcd"
+)
+
+// indexPrefix is the etcd path where index keys are stored, for each indexed
+// field and value there is a key for every resource with that value.
+const indexPrefix = "/_etcdrest/indexes"
+
+// indexDir returns the directory of the resources with a value in an index,
+// values are prefixed with "=" so they are never empty or "." or "..".
+func indexDir(collPath, field, value string) string {
+	return indexPrefix + collPath + "/" + url.PathEscape(field) + "/=" + url.PathEscape(value)
+}
+
+// values returns the scalar values of a field as strings, "*" matches every
+// value of an object or element of an array.
+func values(doc interface{}, path []string) []string {
+	if len(path) == 0 {
+		if s, ok := valueString(doc); ok {
+			return []string{s}
+		}
+		return nil
+	}
+
+	l := []string{}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if path[0] == "*" {
+			for _, e := range v {
+				l = append(l, values(e, path[1:])...)
+			}
+		} else if e, ok := v[path[0]]; ok {
+			l = append(l, values(e, path[1:])...)
+		}
+	case []interface{}:
+		if path[0] == "*" {
+			for _, e := range v {
+				l = append(l, values(e, path[1:])...)
+			}
+		} else if i, err := strconv.Atoi(path[0]); err == nil && i >= 0 && i < len(v) {
+			l = append(l, values(v[i], path[1:])...)
+		}
+	}
+	return l
+}
+
+// hasValue returns true if a field of a document has the value.
+func hasValue(doc interface{}, field, value string) bool {
+	for _, v := range values(doc, strings.Split(field, ".")) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// indexed returns true if the route has an index on the field.
+func (rt *route) indexed(field string) bool {
+	for _, f := range rt.indexes {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// indexKeys returns the index keys of a document.
+func (rt *route) indexKeys(collPath, name string, doc interface{}) map[string]string {
+	keys := map[string]string{}
+	if doc == nil {
+		return keys
+	}
+
+	for _, f := range rt.indexes {
+		for _, v := range values(doc, strings.Split(f, ".")) {
+			keys[indexDir(collPath, f, v)+"/"+url.PathEscape(name)] = ""
+		}
+	}
+	return keys
+}
+
+// indexChanges returns the index keys to set and to delete when a document
+// with the old keys is replaced by a document with the new keys.
+func indexChanges(oldKeys, newKeys map[string]string) (map[string]string, []string) {
+	del := []string{}
+	for k := range oldKeys {
+		if _, ok := newKeys[k]; !ok {
+			del = append(del, k)
+		}
+	}
+	return newKeys, del
+}
+
+// collectionOf returns the collection path and the name of a resource.
+func (c *config) collectionOf(vars map[string]string, rt *route, path string) (string, string) {
+	collPath := c.render(rt.collection, vars)
+	return collPath, strings.TrimPrefix(path, collPath+"/")
+}
+
+// merge returns the keys of both maps.
+func merge(a, b map[string]string) map[string]string {
+	m := map[string]string{}
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
+
+// putKeys set the keys outside a document to update when the old document is
+// replaced, including the keys of documents of other routes stored inside it.
+func (c *config) putKeys(rt *route, vars map[string]string, path string, old, data interface{}, opts *etcd.PutOptions) error {
+	oldKeys, oldClaims, err := c.docKeys(rt, vars, path, old)
+	if err != nil {
+		// The stored document already has the conflict, release what it claims.
+		oldKeys, oldClaims = c.ownKeys(rt, vars, path, old)
+	}
+	newKeys, newClaims, err := c.docKeys(rt, vars, path, data)
+	if err != nil {
+		return err
+	}
+
+	opts.SetKeys, opts.DeleteKeys = indexChanges(oldKeys, newKeys)
+	opts.ClaimKeys, opts.ReleaseKeys = uniqueChanges(oldClaims, newClaims)
+	return nil
+}
+
+// deleteKeys set the keys outside a document to remove with it, including the
+// keys of documents of other routes stored inside it.
+func (c *config) deleteKeys(rt *route, vars map[string]string, path string, data interface{}, opts *etcd.DeleteOptions) {
+	keys, claims, err := c.docKeys(rt, vars, path, data)
+	if err != nil {
+		keys, claims = c.ownKeys(rt, vars, path, data)
+	}
+	_, opts.DeleteKeys = indexChanges(keys, nil)
+	_, opts.ReleaseKeys = uniqueChanges(claims, nil)
+}
+
+// lookup returns the names of the resources with a value in an index.
+func (c *config) lookup(ctx context.Context, collPath, field, value string) ([]string, int, error) {
+	names, code, err := c.session.List(ctx, indexDir(collPath, field, value))
+	if code == http.StatusNotFound {
+		return []string{}, http.StatusOK, nil
+	}
+	if err != nil {
+		return nil, code, err
+	}
+
+	for i, n := range names {
+		if s, err := url.PathUnescape(n); err == nil {
+			names[i] = s
+		}
+	}
+	return names, http.StatusOK, nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/mickep76/etcdrest/etcd"
+	"github.com/mickep76/etcdrest/pattern"
+)
+
+// nestedDoc is a document of another route stored inside a document.
+type nestedDoc struct {
+	rt   *route
+	vars map[string]string
+	path string
+	doc  interface{}
+}
+
+// nested returns the routes with documents stored directly inside the documents of a route.
+func (c *config) nested(rt *route) []*route {
+	inside := func(a, b *route) bool {
+		return a != b && strings.HasPrefix(a.resourcePath, b.resourcePath+"/")
+	}
+
+	l := []*route{}
+	for _, ch := range c.routes {
+		if !inside(ch, rt) {
+			continue
+		}
+
+		direct := true
+		for _, m := range c.routes {
+			if inside(ch, m) && inside(m, rt) {
+				direct = false
+				break
+			}
+		}
+		if direct {
+			l = append(l, ch)
+		}
+	}
+	return l
+}
+
+// nests returns true if documents of other routes are stored inside the documents of a route.
+func (c *config) nests(rt *route) bool {
+	return len(c.nested(rt)) > 0
+}
+
+// keyed returns true if writes to the route, or to routes stored inside it,
+// update keys outside the document.
+func (c *config) keyed(rt *route) bool {
+	if rt.keyed() {
+		return true
+	}
+	for _, ch := range c.nested(rt) {
+		if c.keyed(ch) {
+			return true
+		}
+	}
+	return false
+}
+
+// subDoc returns the value at a path below the path of a document.
+func subDoc(doc interface{}, path, p string) (interface{}, bool) {
+	if !strings.HasPrefix(p, path+"/") {
+		return nil, false
+	}
+
+	for _, k := range strings.Split(strings.TrimPrefix(p, path+"/"), "/") {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// nestedDocs returns the documents of other routes stored inside a document.
+func (c *config) nestedDocs(rt *route, vars map[string]string, path string, doc interface{}) []nestedDoc {
+	l := []nestedDoc{}
+	if doc == nil {
+		return l
+	}
+
+	have := map[string]bool{}
+	for k := range vars {
+		have[k] = true
+	}
+
+	for _, ch := range c.nested(rt) {
+		// Single resource without an ID.
+		if ch.idVar == "" {
+			if subset(pattern.Vars(ch.resource), have) != "" {
+				continue
+			}
+			p := c.render(ch.resource, vars)
+			if d, ok := subDoc(doc, path, p); ok {
+				l = append(l, nestedDoc{rt: ch, vars: vars, path: p, doc: d})
+			}
+			continue
+		}
+
+		if subset(pattern.Vars(ch.collection), have) != "" {
+			continue
+		}
+		collPath := c.render(ch.collection, vars)
+		d, _ := subDoc(doc, path, collPath)
+		m, _ := d.(map[string]interface{})
+		for name, e := range m {
+			v := withVar(vars, ch.idVar, name)
+			if p := c.render(ch.resource, v); p == collPath+"/"+name {
+				l = append(l, nestedDoc{rt: ch, vars: v, path: p, doc: e})
+			}
+		}
+	}
+	return l
+}
+
+// ownKeys returns the index and reference keys of a document and the unique values it claims.
+func (c *config) ownKeys(rt *route, vars map[string]string, path string, doc interface{}) (map[string]string, map[string]string) {
+	collPath, name := c.collectionOf(vars, rt, path)
+	return merge(rt.indexKeys(collPath, name, doc), c.referenceKeys(rt, vars, path, doc)), rt.uniqueKeys(path, doc)
+}
+
+// docKeys returns the keys of a document including the documents of other
+// routes stored inside it, an error is returned if two of them claim the same value.
+func (c *config) docKeys(rt *route, vars map[string]string, path string, doc interface{}) (map[string]string, map[string]string, error) {
+	keys, claims := c.ownKeys(rt, vars, path, doc)
+	for _, n := range c.nestedDocs(rt, vars, path, doc) {
+		k, cl, err := c.docKeys(n.rt, n.vars, n.path, n.doc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for key, holder := range cl {
+			if h, ok := claims[key]; ok && h != holder {
+				return nil, nil, c.conflict(&etcd.ClaimError{Key: key, Holder: h})
+			}
+			claims[key] = holder
+		}
+		keys = merge(keys, k)
+	}
+	return keys, claims, nil
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mickep76/etcdrest/pattern"
+)
+
+// openAPIVersion is the version of the OpenAPI specification the document
+// follows, 3.1 schemas are JSON schemas so the schema files can be used as they are.
+const openAPIVersion = "3.1.0"
+
+// componentRegexp matches characters that aren't allowed in the name of a component.
+var componentRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// queryParams are the query parameters described in the document.
+var queryParams = map[string]map[string]interface{}{
+	"table":      {"type": "boolean", "description": "Return a list of resources with the name in the dirName field"},
+	"limit":      {"type": "integer", "description": "Number of resources per page"},
+	"cursor":     {"type": "string", "description": "Continue after the previous page"},
+	"offset":     {"type": "integer", "description": "Skip the first resources"},
+	"sort":       {"type": "string", "description": "Sort by a field, -<field> for descending order"},
+	"q":          {"type": "string", "description": "jq style expression run on the result"},
+	"indexField": {"type": "string", "description": "Field to look up in its index"},
+	"value":      {"type": "string", "description": "Value to look up in the index"},
+	"watch":      {"type": "boolean", "description": "Wait for changes"},
+	"index":      {"type": "integer", "description": "Resume a watch after the etcd index"},
+	"dryRun":     {"type": "boolean", "description": "Check the request without writing anything"},
+}
+
+// bundle collects the schema files of a document as components, references
+// between the files point to the components.
+type bundle struct {
+	c       *config
+	schemas map[string]interface{}
+	names   map[string]string
+}
+
+// componentName returns the name of the component of a schema file, files
+// with the same name once replaced characters are numbered.
+func (b *bundle) componentName(file string) string {
+	base := componentRegexp.ReplaceAllString(strings.TrimSuffix(file, ".json"), "_")
+	name := base
+	for i := 2; ; i++ {
+		if _, ok := b.schemas[name]; !ok {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+}
+
+// add a schema file and the files it references, returns a reference to the component.
+func (b *bundle) add(file string) (string, error) {
+	file = path.Clean(file)
+	if name, ok := b.names[file]; ok {
+		return "#/components/schemas/" + name, nil
+	}
+	name := b.componentName(file)
+	ref := "#/components/schemas/" + name
+	b.names[file] = name
+
+	s, err := b.c.schemaFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	// Added before it's rewritten so a file can reference itself.
+	b.schemas[name] = s
+	v, err := b.rewrite(file, s)
+	if err != nil {
+		return "", err
+	}
+
+	m := v.(map[string]interface{})
+	delete(m, "$id")
+	if _, ok := m["id"].(string); ok {
+		delete(m, "id")
+	}
+	b.schemas[name] = m
+	return ref, nil
+}
+
+// rewrite returns a schema with every $ref pointing to a component.
+func (b *bundle) rewrite(file string, v interface{}) (interface{}, error) {
+	switch e := v.(type) {
+	case map[string]interface{}:
+		// Files are added in the same order every time so they keep their component names.
+		keys := []string{}
+		for k := range e {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		m := map[string]interface{}{}
+		for _, k := range keys {
+			x := e[k]
+			if ref, ok := x.(string); ok && k == "$ref" {
+				name, pointer := ref, ""
+				if i := strings.Index(ref, "#"); i >= 0 {
+					name, pointer = ref[:i], ref[i+1:]
+				}
+
+				// References to other servers are left as they are.
+				if strings.Contains(name, "://") {
+					m[k] = ref
+					continue
+				}
+				if name != "" {
+					name = path.Join(path.Dir(file), name)
+				} else {
+					name = file
+				}
+
+				r, err := b.add(name)
+				if err != nil {
+					return nil, err
+				}
+				m[k] = r + pointer
+				continue
+			}
+
+			var err error
+			if m[k], err = b.rewrite(file, x); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		l := []interface{}{}
+		for _, x := range e {
+			r, err := b.rewrite(file, x)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, r)
+		}
+		return l, nil
+	}
+	return v, nil
+}
+
+// openAPIPath returns a route as an OpenAPI path and the parameters for its variables.
+func openAPIPath(route string) (string, []interface{}) {
+	params := []interface{}{}
+	for _, m := range pattern.VarRegexp.FindAllStringSubmatch(route, -1) {
+		schema := map[string]interface{}{"type": "string"}
+		if m[2] != "" {
+			schema["pattern"] = "^" + strings.TrimPrefix(m[2], ":") + "$"
+		}
+		params = append(params, map[string]interface{}{
+			"name":     strings.TrimSpace(m[1]),
+			"in":       "path",
+			"required": true,
+			"schema":   schema,
+		})
+	}
+
+	p := pattern.VarRegexp.ReplaceAllStringFunc(route, func(s string) string {
+		return "{" + strings.TrimSpace(pattern.VarRegexp.FindStringSubmatch(s)[1]) + "}"
+	})
+	return p, params
+}
+
+// staticFiles returns the files under the directory of a static route, names
+// that would be read as a path parameter are left out.
+func staticFiles(dir string) ([]string, error) {
+	files := []string{}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return files, nil
+	}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if f := filepath.ToSlash(rel); !strings.ContainsAny(f, "{}") {
+			files = append(files, f)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// jsonContent returns the content of a JSON body with a schema.
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// operation returns an OpenAPI operation with a response and the error response.
+func operation(summary string, params []string, code, description string, content map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{"description": description}
+	if content != nil {
+		res["content"] = content
+	}
+
+	op := map[string]interface{}{
+		"summary": summary,
+		"responses": map[string]interface{}{
+			code:      res,
+			"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+		},
+	}
+
+	if len(params) > 0 {
+		refs := []interface{}{}
+		for _, p := range params {
+			refs = append(refs, map[string]interface{}{"$ref": "#/components/parameters/" + p})
+		}
+		op["parameters"] = refs
+	}
+	return op
+}
+
+// withBody returns an operation with a request body.
+func withBody(op map[string]interface{}, content map[string]interface{}) map[string]interface{} {
+	op["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	return op
+}
+
+// openAPI returns an OpenAPI document for the routes, the schemas of the
+// routes and the schemas they reference are bundled as components.
+func (c *config) openAPI() (map[string]interface{}, error) {
+	b := &bundle{c: c, schemas: map[string]interface{}{}, names: map[string]string{}}
+	paths := map[string]interface{}{}
+
+	names := []string{}
+	for n := range c.routes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		rt := c.routes[n]
+		ref, err := b.add(rt.schema)
+		if err != nil {
+			return nil, err
+		}
+		schema := map[string]interface{}{"$ref": ref}
+
+		// Collection of the route.
+		p, params := openAPIPath(rt.collection)
+		item := map[string]interface{}{
+			"parameters": params,
+			"get": operation("List resources", []string{"table", "limit", "cursor", "offset", "sort", "q", "indexField", "value", "watch", "index"}, "200",
+				"Resources by name, or a list of resources with table=true", jsonContent(map[string]interface{}{
+					"oneOf": []interface{}{
+						map[string]interface{}{"type": "object", "additionalProperties": schema},
+						map[string]interface{}{"type": "array", "items": schema},
+					},
+				})),
+		}
+		if rt.idVar != "" {
+			op := withBody(operation("Create resource with a server-generated ID", nil, "201", "Created", jsonContent(schema)), jsonContent(schema))
+			op["responses"].(map[string]interface{})["201"].(map[string]interface{})["headers"] = map[string]interface{}{
+				"Location": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+			item["post"] = op
+		}
+		paths[p] = item
+
+		// Resource of the route.
+		p, params = openAPIPath(rt.resource)
+		get := operation("Get resource", []string{"watch", "index"}, "200", "Resource", jsonContent(schema))
+		get["responses"].(map[string]interface{})["200"].(map[string]interface{})["headers"] = map[string]interface{}{
+			"ETag": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+		paths[p] = map[string]interface{}{
+			"parameters": params,
+			"get":        get,
+			"put":        withBody(operation("Create or replace resource", []string{"dryRun"}, "200", "Resource", jsonContent(schema)), jsonContent(schema)),
+			"patch": withBody(operation("Patch resource", []string{"dryRun"}, "200", "Resource", jsonContent(schema)), map[string]interface{}{
+				mimeMergePatch:                map[string]interface{}{"schema": map[string]interface{}{"type": "object"}},
+				"application/json-patch+json": map[string]interface{}{"schema": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}},
+			}),
+			"delete": operation("Delete resource", []string{"dryRun"}, "200", "Deleted resource", jsonContent(schema)),
+		}
+	}
+
+	for e := range c.templRoutes {
+		p, params := openAPIPath(e)
+		paths[p] = map[string]interface{}{
+			"parameters": params,
+			"get": operation("Render template", nil, "200", "Template output", map[string]interface{}{
+				"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}),
+		}
+	}
+
+	// A path parameter can't hold a "/", so every file is a path of its own.
+	for _, st := range c.statics {
+		files, err := staticFiles(st.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			paths[st.endpoint+"/"+f] = map[string]interface{}{
+				"get": operation("Get file", nil, "200", "File", map[string]interface{}{
+					"application/octet-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+				}),
+			}
+		}
+	}
+
+	p, params := openAPIPath("/_validate/{schema}")
+	paths[p] = map[string]interface{}{
+		"parameters": params,
+		"post":       withBody(operation("Validate document against a schema", nil, "200", "Valid document", jsonContent(map[string]interface{}{})), jsonContent(map[string]interface{}{})),
+	}
+
+	parameters := map[string]interface{}{}
+	for n, s := range queryParams {
+		parameters[n] = map[string]interface{}{
+			"name":        n,
+			"in":          "query",
+			"description": s["description"],
+			"schema":      map[string]interface{}{"type": s["type"]},
+		}
+	}
+
+	doc := map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "etcdrest",
+			"version": c.version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas":    b.schemas,
+			"parameters": parameters,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Errors",
+					"content":     jsonContent(map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}),
+				},
+			},
+		},
+	}
+	if c.serverURI != "" {
+		doc["servers"] = []interface{}{map[string]interface{}{"url": c.serverURI}}
+	}
+	return doc, nil
+}
+
+// getOpenAPI write the OpenAPI document, it's never enveloped.
+func (c *config) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	doc, err := c.openAPI()
+	if err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.writeMIME(w, r, doc, http.StatusOK)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcdrest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A static route for every path is added before the OpenAPI endpoint is served.
+	ts := newTestServer(t, func(c *config) {
+		c.RouteStatic("", dir)
+	})
+
+	_, b := expect(t, ts, http.StatusOK, "GET", "/_openapi.json", "")
+	doc := decodeBody(t, b).(map[string]interface{})
+	if doc["openapi"] != openAPIVersion {
+		t.Errorf("openapi is %v, want %s", doc["openapi"], openAPIVersion)
+	}
+	if _, ok := doc["jsonSchemaDialect"]; ok {
+		t.Errorf("jsonSchemaDialect is set: %v", doc["jsonSchemaDialect"])
+	}
+
+	paths := doc["paths"].(map[string]interface{})
+	for _, p := range []string{"/api/hosts", "/api/hosts/{host}", "/api/hosts/{host}/interfaces/{interface}", "/a/b.txt"} {
+		if _, ok := paths[p]; !ok {
+			t.Errorf("missing path: %s", p)
+		}
+	}
+
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	for _, n := range []string{"site", "host", "interface"} {
+		if _, ok := schemas[n]; !ok {
+			t.Errorf("missing schema: %s", n)
+		}
+	}
+
+	expect(t, ts, http.StatusOK, "GET", "/a/b.txt", "")
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mickep76/etcdrest/jq"
+)
+
+// paged returns true if the request asks for a page or a subset of a collection.
+func paged(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Get("limit") != "" || q.Get("offset") != "" || q.Get("cursor") != "" || q.Get("sort") != "" ||
+		q.Get("q") != "" || q.Get("indexField") != "" || len(filters(r)) > 0
+}
+
+// field returns the value of a field in a document, nested fields are separated by ".".
+func field(doc interface{}, name string) (interface{}, bool) {
+	for _, k := range strings.Split(name, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			e, ok := v[k]
+			if !ok {
+				return nil, false
+			}
+			doc = e
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// getPage get a page of a collection, filtered and sorted by name or a field.
+func (c *config) getPage(w http.ResponseWriter, r *http.Request, rt *route, path string, table bool) {
+	q := r.URL.Query()
+
+	var query *jq.Query
+	if s := q.Get("q"); s != "" {
+		var err error
+		if query, err = jq.Parse(s); err != nil {
+			c.writeError(w, r, fmt.Errorf("invalid query: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		// The query transforms the whole result, so a page of it can't be continued.
+		if q.Get("limit") != "" || q.Get("offset") != "" || q.Get("cursor") != "" {
+			c.writeError(w, r, fmt.Errorf("q can't be combined with limit, offset or cursor"), http.StatusBadRequest)
+			return
+		}
+	}
+	fs := filters(r)
+
+	var limit, offset int
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{{"limit", &limit}, {"offset", &offset}} {
+		if s := q.Get(p.name); s != "" {
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 {
+				c.writeError(w, r, fmt.Errorf("invalid %s: %s", p.name, s), http.StatusBadRequest)
+				return
+			}
+			*p.v = i
+		}
+	}
+
+	sortField := q.Get("sort")
+	desc := strings.HasPrefix(sortField, "-")
+	sortField = strings.TrimPrefix(sortField, "-")
+
+	// Cursor is the name of the last resource of the previous page.
+	var after string
+	if s := q.Get("cursor"); s != "" {
+		if sortField != "" || q.Get("offset") != "" {
+			c.writeError(w, r, fmt.Errorf("cursor can't be combined with sort or offset"), http.StatusBadRequest)
+			return
+		}
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			c.writeError(w, r, fmt.Errorf("invalid cursor: %s", s), http.StatusBadRequest)
+			return
+		}
+		after = string(b)
+	}
+
+	dirName := rt.dirName
+	if dirName == "" {
+		dirName = "dir"
+	}
+
+	// Sorting or filtering by a field needs every document, otherwise only the page is read.
+	var names []string
+	var docs map[string]interface{}
+	if indexField := q.Get("indexField"); indexField != "" {
+		if !rt.indexed(indexField) {
+			c.writeError(w, r, fmt.Errorf("no index on field: %s", indexField), http.StatusBadRequest)
+			return
+		}
+
+		// Documents written before the index was declared are only found once their keys are added.
+		ok, code, err := c.backfilled(r.Context(), rt, "indexes", indexField)
+		if err != nil {
+			c.writeError(w, r, err, code)
+			return
+		}
+		if !ok {
+			c.writeError(w, r, fmt.Errorf("index on field isn't complete: %s", indexField), http.StatusServiceUnavailable)
+			return
+		}
+
+		// Read the resources in the index, skipping any that no longer have the value.
+		value := q.Get("value")
+		l, code, err := c.lookup(r.Context(), path, indexField, value)
+		if err != nil {
+			c.writeError(w, r, err, code)
+			return
+		}
+
+		docs = map[string]interface{}{}
+		for _, n := range l {
+			doc, _, code, err := c.get(r.Context(), rt, path+"/"+n, false)
+			if code == http.StatusNotFound {
+				continue
+			}
+			if err != nil {
+				c.writeError(w, r, err, code)
+				return
+			}
+			if hasValue(doc, indexField, value) && match(doc, n, dirName, fs) {
+				docs[n] = doc
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+	} else if sortField != "" || len(fs) > 0 || limit == 0 {
+		d, _, code, err := c.get(r.Context(), rt, path, false)
+		if err != nil {
+			c.writeError(w, r, err, code)
+			return
+		}
+
+		docs, _ = d.(map[string]interface{})
+		for n, doc := range docs {
+			if match(doc, n, dirName, fs) {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+	} else {
+		var code int
+		var err error
+		names, code, err = c.session.List(r.Context(), path)
+		if err != nil {
+			c.writeError(w, r, err, code)
+			return
+		}
+	}
+
+	if sortField != "" {
+		value := func(n string) (interface{}, bool) {
+			if sortField == dirName {
+				return n, true
+			}
+			return field(docs[n], sortField)
+		}
+
+		// Documents without the field are always last.
+		sort.SliceStable(names, func(i, j int) bool {
+			a, aok := value(names[i])
+			b, bok := value(names[j])
+			if !aok || !bok {
+				return aok && !bok
+			}
+			if desc {
+				return jq.Compare(a, b) > 0
+			}
+			return jq.Compare(a, b) < 0
+		})
+	}
+
+	if after != "" {
+		names = names[sort.Search(len(names), func(i int) bool { return names[i] > after }):]
+	}
+
+	if offset > len(names) {
+		offset = len(names)
+	}
+	names = names[offset:]
+
+	more := false
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+		more = true
+	}
+
+	var arr []interface{}
+	m := map[string]interface{}{}
+	for _, n := range names {
+		doc, ok := docs[n]
+		if docs == nil {
+			var code int
+			var err error
+			doc, _, code, err = c.get(r.Context(), rt, path+"/"+n, false)
+			if code == http.StatusNotFound {
+				continue
+			}
+			if err != nil {
+				c.writeError(w, r, err, code)
+				return
+			}
+		} else if !ok {
+			continue
+		}
+
+		if table {
+			if d, ok := doc.(map[string]interface{}); ok {
+				d[dirName] = n
+				arr = append(arr, d)
+			}
+			continue
+		}
+		m[n] = doc
+	}
+
+	var data interface{} = m
+	if table {
+		if arr == nil {
+			arr = []interface{}{}
+		}
+		data = arr
+	}
+
+	// Run query on the result.
+	if query != nil {
+		out, err := query.Run(data)
+		if err != nil {
+			c.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		data = out
+	}
+
+	// Link to the next page.
+	var meta map[string]interface{}
+	if more && len(names) > 0 {
+		if sortField != "" || q.Get("offset") != "" {
+			q.Set("offset", strconv.Itoa(offset+limit))
+		} else {
+			q.Set("cursor", base64.RawURLEncoding.EncodeToString([]byte(names[len(names)-1])))
+		}
+
+		next := c.serverURI + r.URL.Path + "?" + q.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next))
+		meta = map[string]interface{}{"next": next}
+	}
+
+	if table && query == nil {
+		c.writeTable(w, r, rt, data, http.StatusOK, meta)
+		return
+	}
+
+	c.writeMeta(w, r, data, http.StatusOK, meta)
+}
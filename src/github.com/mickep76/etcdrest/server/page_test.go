@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tableNames returns the names of the resources in a table.
+func tableNames(t *testing.T, b string) []string {
+	l := []string{}
+	for _, e := range decodeBody(t, b).([]interface{}) {
+		l = append(l, fmt.Sprint(e.(map[string]interface{})["site"]))
+	}
+	return l
+}
+
+func TestPage(t *testing.T) {
+	ts := newTestServer(t)
+	for i, region := range []string{"eu", "us", "eu", "ap", "us"} {
+		expect(t, ts, http.StatusOK, "PUT", fmt.Sprintf("/api/sites/s%d", i+1), fmt.Sprintf(`{"region": %q, "rank": %d, "address": {"city": "c%d"}}`, region, 5-i, i%2))
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"limit=2", []string{"s1", "s2"}},
+		{"limit=2&offset=3", []string{"s4", "s5"}},
+		{"offset=4", []string{"s5"}},
+		{"sort=rank", []string{"s5", "s4", "s3", "s2", "s1"}},
+		{"sort=-rank&limit=2", []string{"s1", "s2"}},
+		{"sort=region&limit=3", []string{"s4", "s1", "s3"}},
+		{"region=eu", []string{"s1", "s3"}},
+		{"region=eu&region=ap", []string{"s1", "s3", "s4"}},
+		{"address.city=c1", []string{"s2", "s4"}},
+		{"region=us&sort=-rank", []string{"s2", "s5"}},
+	}
+	for _, tc := range tests {
+		_, b := expect(t, ts, http.StatusOK, "GET", "/api/sites?table=true&"+tc.query, "")
+		if got := tableNames(t, b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	for _, query := range []string{"limit=x", "offset=-1", "cursor=!!", "q=.[]&limit=1", "q=.["} {
+		expect(t, ts, http.StatusBadRequest, "GET", "/api/sites?table=true&"+query, "")
+	}
+
+	// Following the Link header returns every resource once.
+	got := []string{}
+	path := "/api/sites?table=true&limit=2"
+	for i := 0; path != "" && i < 5; i++ {
+		res, b := expect(t, ts, http.StatusOK, "GET", path, "")
+		got = append(got, tableNames(t, b)...)
+
+		path = ""
+		if l := res.Header.Get("Link"); l != "" {
+			path = strings.TrimSuffix(strings.TrimPrefix(l, "<"), `>; rel="next"`)
+		}
+	}
+	if want := []string{"s1", "s2", "s3", "s4", "s5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pages got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mickep76/etcdrest/etcd"
+	"github.com/mickep76/etcdrest/log"
+)
+
+// idempotencyPrefix is the etcd path where idempotency keys are stored.
+const idempotencyPrefix = "/_etcdrest/idempotency"
+
+// idempotencyTTL is the time an idempotency key is kept.
+const idempotencyTTL = 24 * time.Hour
+
+// idempotencyClaimTTL is the time an idempotency key is kept before the
+// resource is created, so a request that never finishes can be retried.
+const idempotencyClaimTTL = time.Minute
+
+// idempotencyRecord is stored for each idempotency key.
+type idempotencyRecord struct {
+	Hash string `json:"hash"`
+	ID   string `json:"id,omitempty"`
+}
+
+// hash returns the SHA-256 of the data as hex.
+func hash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// copyVars returns a copy of the request variables.
+func copyVars(r *http.Request) map[string]string {
+	vars := map[string]string{}
+	for k, v := range mux.Vars(r) {
+		vars[k] = v
+	}
+	return vars
+}
+
+// postDoc create document with a server-generated ID.
+func (c *config) postDoc(rt *route) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var collPath bytes.Buffer
+
+		err := c.templ.ExecuteTemplate(&collPath, rt.collection, mux.Vars(r))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		log.Infof("etcd path: %s", collPath.String())
+
+		// Import a CSV with a resource for each row.
+		if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && t == mimeCSV {
+			c.importCSV(w, r, rt)
+			return
+		}
+
+		// Get request body.
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			c.writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if err := r.Body.Close(); err != nil {
+			c.writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		// Convert a YAML or TOML body to JSON.
+		body, _, err = bodyJSON(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			c.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		// Fill in defaults of the schema.
+		if body, err = c.withDefaults(body, rt.schema); err != nil {
+			c.writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		// Validate document using JSON schema
+		if code, errors := c.validateDoc(body, collPath.String(), rt.schema); errors != nil {
+			c.writeErrors(w, r, errors, code)
+			return
+		}
+
+		var data interface{}
+		if err := json.Unmarshal(body, &data); err != nil {
+			c.writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		// The parent and referenced resources must exist.
+		if code, err := c.checkReferences(r.Context(), rt, mux.Vars(r), data); err != nil {
+			c.writeError(w, r, err, code)
+			return
+		}
+
+		// Claim the idempotency key, if it's already taken this is a retry.
+		var record string
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			record = idempotencyPrefix + "/" + hash([]byte(collPath.String()+"\n"+key))
+			b, _ := json.Marshal(&idempotencyRecord{Hash: hash(body)})
+			code, err := c.session.PutBlob(r.Context(), record, b, &etcd.PutOptions{PrevNoExist: true, TTL: idempotencyClaimTTL})
+			if code == http.StatusPreconditionFailed {
+				c.replayPost(w, r, rt, record, hash(body))
+				return
+			}
+			if err != nil {
+				c.writeError(w, r, err, code)
+				return
+			}
+		}
+
+		vars, code, err := c.createDoc(r, rt, collPath.String(), record, body, data)
+		if err != nil {
+			// Release the idempotency key so the request can be retried.
+			if record != "" {
+				if _, err := c.session.Delete(r.Context(), record, nil); err != nil {
+					log.Infof("Failed to remove idempotency key: %s: %s", record, err.Error())
+				}
+			}
+			c.writeError(w, r, err, code)
+			return
+		}
+
+		c.writeCreated(w, r, rt, vars, data)
+	}
+}
+
+// createDoc generate an ID and create the document, returns the request variables including the ID.
+func (c *config) createDoc(r *http.Request, rt *route, collPath, record string, body []byte, data interface{}) (map[string]string, int, error) {
+	id, code, err := c.newID(r.Context(), rt, collPath)
+	if err != nil {
+		return nil, code, err
+	}
+	vars := copyVars(r)
+	vars[rt.idVar] = id
+
+	var newPath bytes.Buffer
+	if err := c.templ.ExecuteTemplate(&newPath, rt.resource, vars); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	log.Infof("etcd path: %s", newPath.String())
+
+	// An etcd in-order key already exists as an empty value.
+	opts := &etcd.PutOptions{PrevNoExist: rt.idStrategy != IDEtcd}
+	if err := c.putKeys(rt, vars, newPath.String(), nil, data, opts); err != nil {
+		c.dropID(r.Context(), rt, collPath, id)
+		return nil, http.StatusConflict, err
+	}
+	if rt.storage == StorageBlob {
+		code, err = c.session.PutBlob(r.Context(), newPath.String(), body, opts)
+	} else {
+		code, err = c.session.Put(r.Context(), newPath.String(), data, opts)
+	}
+	if err != nil {
+		// A write that timed out may still have been made.
+		if code != http.StatusGatewayTimeout {
+			c.dropID(r.Context(), rt, collPath, id)
+		}
+		return nil, code, c.conflict(err)
+	}
+
+	// Remember the ID for a retry.
+	if record != "" {
+		b, _ := json.Marshal(&idempotencyRecord{Hash: hash(body), ID: id})
+		if _, err := c.session.PutBlob(r.Context(), record, b, &etcd.PutOptions{TTL: idempotencyTTL}); err != nil {
+			log.Infof("Failed to update idempotency key: %s: %s", record, err.Error())
+		}
+	}
+
+	return vars, http.StatusCreated, nil
+}
+
+// replayPost answer a retry of a request with the resource that was created.
+func (c *config) replayPost(w http.ResponseWriter, r *http.Request, rt *route, record string, bodyHash string) {
+	d, _, code, err := c.session.GetBlob(r.Context(), record, false, "")
+	if err != nil {
+		c.writeError(w, r, err, code)
+		return
+	}
+
+	var rec idempotencyRecord
+	b, _ := json.Marshal(d)
+	if err := json.Unmarshal(b, &rec); err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if rec.Hash != bodyHash {
+		c.writeError(w, r, fmt.Errorf("idempotency key has been used with a different request"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if rec.ID == "" {
+		c.writeError(w, r, fmt.Errorf("request with the same idempotency key is in progress"), http.StatusConflict)
+		return
+	}
+
+	log.Infof("Replay request with idempotency key, id: %s", rec.ID)
+	vars := copyVars(r)
+	vars[rt.idVar] = rec.ID
+
+	var newPath bytes.Buffer
+	if err := c.templ.ExecuteTemplate(&newPath, rt.resource, vars); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	data, _, code, err := c.get(r.Context(), rt, newPath.String(), false)
+	if err != nil {
+		c.writeError(w, r, err, code)
+		return
+	}
+
+	c.writeCreated(w, r, rt, vars, data)
+}
+
+// writeCreated write 201 Created with the location of the resource.
+func (c *config) writeCreated(w http.ResponseWriter, r *http.Request, rt *route, vars map[string]string, data interface{}) {
+	pairs := []string{}
+	for k, v := range vars {
+		pairs = append(pairs, k, v)
+	}
+
+	u, err := rt.resourceRoute.URLPath(pairs...)
+	if err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", c.serverURI+u.String())
+	c.writeCode(w, r, data, http.StatusCreated)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPost(t *testing.T) {
+	ts := newTestServer(t)
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{}`)
+	expect(t, ts, http.StatusCreated, "POST", "/api/hosts", `{"site": "sto1", "serial": "1"}`)
+
+	for _, tc := range []struct {
+		name, body string
+		headers    []string
+		code       int
+	}{
+		{"invalid", `{"serial": "2"}`, nil, http.StatusBadRequest},
+		{"unique", `{"site": "sto1", "serial": "1"}`, nil, http.StatusConflict},
+		{"reference", `{"site": "sto2", "serial": "2"}`, nil, http.StatusUnprocessableEntity},
+		{"idempotent", `{"site": "sto1", "serial": "2"}`, []string{"Idempotency-Key", "a"}, http.StatusCreated},
+		{"retry", `{"site": "sto1", "serial": "2"}`, []string{"Idempotency-Key", "a"}, http.StatusCreated},
+		{"reused key", `{"site": "sto1", "serial": "3"}`, []string{"Idempotency-Key", "a"}, http.StatusUnprocessableEntity},
+		{"failed key", `{"site": "sto1", "serial": "1"}`, []string{"Idempotency-Key", "b"}, http.StatusConflict},
+		{"released key", `{"site": "sto1", "serial": "4"}`, []string{"Idempotency-Key", "b"}, http.StatusCreated},
+	} {
+		if res, b := do(t, ts, "POST", "/api/hosts", tc.body, tc.headers...); res.StatusCode != tc.code {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, res.StatusCode, tc.code, b)
+		}
+	}
+
+	// Failed requests leave no resource behind, a retry returns the same resource.
+	_, b := expect(t, ts, http.StatusOK, "GET", "/api/hosts", "")
+	if docs := decodeBody(t, b).(map[string]interface{}); len(docs) != 3 {
+		t.Errorf("got %d hosts, want 3: %s", len(docs), b)
+	}
+}
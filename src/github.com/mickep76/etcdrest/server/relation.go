@@ -0,0 +1,577 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mickep76/etcdrest/etcd"
+	"github.com/mickep76/etcdrest/log"
+	"github.com/mickep76/etcdrest/pattern"
+)
+
+// Policies for the resources that depend on a resource that is deleted.
+const (
+	OnDeleteRestrict = "restrict"
+	OnDeleteCascade  = "cascade"
+	OnDeleteNullify  = "nullify"
+)
+
+// referencePrefix is the etcd path where reference keys are stored, for each
+// referenced resource there is a key for every resource referencing it.
+const referencePrefix = "/_etcdrest/references"
+
+// reference struct.
+type reference struct {
+	field    string
+	route    string
+	onDelete string
+}
+
+// referrer is stored in a reference key.
+type referrer struct {
+	Route  string            `json:"route"`
+	Vars   map[string]string `json:"vars"`
+	Fields []string          `json:"fields"`
+}
+
+// dependent is a resource that depends on a resource that is deleted.
+type dependent struct {
+	rt       *route
+	vars     map[string]string
+	path     string
+	onDelete string
+	fields   []string
+	id       string
+}
+
+// referenceDir returns the directory of the resources referencing a resource.
+func referenceDir(path string) string {
+	return referencePrefix + "/" + url.PathEscape(path)
+}
+
+// render returns the etcd path of a route template.
+func (c *config) render(name string, vars map[string]string) string {
+	var b bytes.Buffer
+	if err := c.templ.ExecuteTemplate(&b, name, vars); err != nil {
+		log.Fatal(err.Error())
+	}
+	return b.String()
+}
+
+// withVar returns a copy of the variables with a variable set.
+func withVar(vars map[string]string, name, value string) map[string]string {
+	m := map[string]string{name: value}
+	for k, v := range vars {
+		if k != name {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// subset returns the first variable of a that isn't in b, or "" if there is none.
+func subset(a, b map[string]bool) string {
+	for v := range a {
+		if !b[v] {
+			return v
+		}
+	}
+	return ""
+}
+
+// checkRelations returns an error if a route has a parent or reference that
+// doesn't exist or can't be resolved from the variables of the route.
+func (c *config) checkRelations() error {
+	for _, rt := range c.routes {
+		if rt.parent != "" {
+			p, ok := c.routes[rt.parent]
+			if !ok {
+				return fmt.Errorf("%s: unknown parent route: %s", rt.resource, rt.parent)
+			}
+			if v := subset(pattern.Vars(p.resource), pattern.Vars(rt.resource)); v != "" {
+				return fmt.Errorf("%s: variable of parent route is missing: %s", rt.resource, v)
+			}
+			if v := subset(pattern.Vars(rt.collection), pattern.Vars(p.resource)); v != "" {
+				return fmt.Errorf("%s: variable of collection route is missing in parent route: %s", rt.resource, v)
+			}
+			if rt.onDelete == OnDeleteNullify {
+				return fmt.Errorf("%s: resource can't be kept without its parent, use restrict or cascade", rt.resource)
+			}
+		}
+
+		for _, ref := range rt.references {
+			t, ok := c.routes[ref.route]
+			if !ok {
+				return fmt.Errorf("%s: unknown route for reference %s: %s", rt.resource, ref.field, ref.route)
+			}
+			if t.idVar == "" {
+				return fmt.Errorf("%s: route for reference %s has no ID: %s", rt.resource, ref.field, ref.route)
+			}
+			if v := subset(pattern.Vars(t.collection), pattern.Vars(rt.resource)); v != "" {
+				return fmt.Errorf("%s: variable of route for reference %s is missing: %s", rt.resource, ref.field, v)
+			}
+		}
+	}
+	return nil
+}
+
+// referenced returns the paths of the resources a document references.
+func (c *config) referenced(rt *route, vars map[string]string, doc interface{}) map[string][]string {
+	paths := map[string][]string{}
+	if doc == nil {
+		return paths
+	}
+
+	for _, ref := range rt.references {
+		t := c.routes[ref.route]
+		for _, v := range values(doc, strings.Split(ref.field, ".")) {
+			p := c.render(t.resource, withVar(vars, t.idVar, v))
+			paths[p] = append(paths[p], ref.field)
+		}
+	}
+	return paths
+}
+
+// checkReferences returns an error if the parent or a resource referenced by a document doesn't exist.
+func (c *config) checkReferences(ctx context.Context, rt *route, vars map[string]string, doc interface{}) (int, error) {
+	if rt.parent != "" {
+		p := c.routes[rt.parent]
+		path := c.render(p.resource, vars)
+		if _, _, code, err := c.get(ctx, p, path, false); err != nil {
+			if code == http.StatusNotFound {
+				return http.StatusUnprocessableEntity, fmt.Errorf("parent resource doesn't exist: %s", path)
+			}
+			return code, err
+		}
+	}
+
+	for path, fields := range c.referenced(rt, vars, doc) {
+		t := c.routes[rt.reference(fields[0]).route]
+		if _, _, code, err := c.get(ctx, t, path, false); err != nil {
+			if code == http.StatusNotFound {
+				return http.StatusUnprocessableEntity, fmt.Errorf("referenced resource doesn't exist: %s: %s", fields[0], path)
+			}
+			return code, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// reference returns the reference of a field.
+func (rt *route) reference(field string) reference {
+	for _, ref := range rt.references {
+		if ref.field == field {
+			return ref
+		}
+	}
+	return reference{field: field, onDelete: OnDeleteRestrict}
+}
+
+// referenceKeys returns the reference keys of a document.
+func (c *config) referenceKeys(rt *route, vars map[string]string, path string, doc interface{}) map[string]string {
+	keys := map[string]string{}
+	for p, fields := range c.referenced(rt, vars, doc) {
+		sort.Strings(fields)
+		b, _ := json.Marshal(&referrer{Route: rt.resource, Vars: vars, Fields: fields})
+		keys[referenceDir(p)+"/"+url.PathEscape(path)] = string(b)
+	}
+	return keys
+}
+
+// dependents returns the resources that depend on a resource, its children
+// and the resources referencing it.
+func (c *config) dependents(ctx context.Context, rt *route, vars map[string]string, path string) ([]dependent, int, error) {
+	deps := []dependent{}
+	for _, ch := range c.routes {
+		if ch.parent != rt.resource {
+			continue
+		}
+
+		// Child without an ID is a single resource.
+		if ch.idVar == "" {
+			p := c.render(ch.resource, vars)
+			if _, _, code, err := c.get(ctx, ch, p, false); err == nil {
+				deps = append(deps, dependent{rt: ch, vars: vars, path: p, onDelete: ch.onDelete})
+			} else if code != http.StatusNotFound {
+				return nil, code, err
+			}
+			continue
+		}
+
+		names, code, err := c.session.List(ctx, c.render(ch.collection, vars))
+		if code == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, code, err
+		}
+		for _, n := range names {
+			v := withVar(vars, ch.idVar, n)
+			deps = append(deps, dependent{rt: ch, vars: v, path: c.render(ch.resource, v), onDelete: ch.onDelete})
+		}
+	}
+
+	d, _, code, err := c.session.GetBlob(ctx, referenceDir(path), false, "")
+	if code == http.StatusNotFound {
+		return deps, http.StatusOK, nil
+	}
+	if err != nil {
+		return nil, code, err
+	}
+
+	m, _ := d.(map[string]interface{})
+	for n, v := range m {
+		var ref referrer
+		b, _ := json.Marshal(v)
+		if err := json.Unmarshal(b, &ref); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		rr, ok := c.routes[ref.Route]
+		if !ok {
+			continue
+		}
+		p, err := url.PathUnescape(n)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		// The strictest policy of the fields referencing the resource applies.
+		onDelete := OnDeleteNullify
+		for _, f := range ref.Fields {
+			switch rr.reference(f).onDelete {
+			case OnDeleteRestrict:
+				onDelete = OnDeleteRestrict
+			case OnDeleteCascade:
+				if onDelete != OnDeleteRestrict {
+					onDelete = OnDeleteCascade
+				}
+			}
+		}
+		deps = append(deps, dependent{rt: rr, vars: ref.Vars, path: p, onDelete: onDelete, fields: ref.Fields, id: vars[rt.idVar]})
+	}
+	return deps, http.StatusOK, nil
+}
+
+// plan add the resources that depend on a resource to deps, following cascades.
+// Every resource that is deleted with it is added to deleted.
+func (c *config) plan(ctx context.Context, rt *route, vars map[string]string, path string, deleted map[string]bool, deps *[]dependent) (int, error) {
+	deleted[path] = true
+	l, code, err := c.dependents(ctx, rt, vars, path)
+	if err != nil {
+		return code, err
+	}
+
+	for _, d := range l {
+		if deleted[d.path] {
+			continue
+		}
+		*deps = append(*deps, d)
+		if d.onDelete == OnDeleteCascade {
+			if code, err := c.plan(ctx, d.rt, d.vars, d.path, deleted, deps); err != nil {
+				return code, err
+			}
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// checkPolicies returns an error if a resource that depends on the deleted
+// documents, or on a resource deleted with them by a cascade, restricts the
+// delete or can't have its reference removed. Nothing is changed.
+func (c *config) checkPolicies(ctx context.Context, docs []nestedDoc, seen map[string]bool) (int, error) {
+	deleted := map[string]bool{}
+	for p := range seen {
+		deleted[p] = true
+	}
+
+	deps := []dependent{}
+	for _, d := range docs {
+		if code, err := c.plan(ctx, d.rt, d.vars, d.path, deleted, &deps); err != nil {
+			return code, err
+		}
+	}
+
+	for _, d := range deps {
+		if deleted[d.path] {
+			continue
+		}
+
+		switch d.onDelete {
+		case OnDeleteRestrict:
+			return http.StatusConflict, fmt.Errorf("resource is used by: %s", d.path)
+		case OnDeleteNullify:
+			if code, err := c.nullify(ctx, d.rt, d.vars, d.path, d.fields, d.id, true); err != nil {
+				return code, err
+			}
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// applyPolicies delete or remove the references of the resources that depend
+// on a resource, the policies must have been checked with checkPolicies.
+func (c *config) applyPolicies(ctx context.Context, rt *route, vars map[string]string, path string, seen map[string]bool) (int, error) {
+	deps, code, err := c.dependents(ctx, rt, vars, path)
+	if err != nil {
+		return code, err
+	}
+
+	for _, d := range deps {
+		if seen[d.path] {
+			continue
+		}
+
+		switch d.onDelete {
+		case OnDeleteRestrict:
+			// Added after the policies were checked.
+			return http.StatusConflict, fmt.Errorf("resource is used by: %s", d.path)
+		case OnDeleteCascade:
+			log.Infof("Cascade delete: %s", d.path)
+			if code, err := c.cascade(ctx, d.rt, d.vars, seen); err != nil {
+				return code, err
+			}
+		case OnDeleteNullify:
+			log.Infof("Remove reference: %s", d.path)
+			if code, err := c.nullify(ctx, d.rt, d.vars, d.path, d.fields, d.id, false); err != nil {
+				return code, err
+			}
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// remove delete a resource and apply the policies of the resources that depend on it.
+// The policies of every resource deleted with it are checked before anything is
+// deleted, a dry run returns the resource without deleting anything.
+func (c *config) remove(ctx context.Context, rt *route, vars map[string]string, prevIndex uint64, mustExist, dryRun bool, seen map[string]bool) (interface{}, int, error) {
+	path := c.render(rt.resource, vars)
+	log.Infof("etcd path: %s", path)
+
+	for retry := 0; ; retry++ {
+		data, index, code, err := c.get(ctx, rt, path, false)
+		if err != nil {
+			if code == http.StatusNotFound && (prevIndex != 0 || mustExist) {
+				code = http.StatusPreconditionFailed
+			}
+			return nil, code, err
+		}
+
+		if code, err := checkIndex(path, index, prevIndex, false); err != nil {
+			return nil, code, err
+		}
+
+		if code, err := c.checkPolicies(ctx, []nestedDoc{{rt: rt, vars: vars, path: path}}, seen); err != nil {
+			return nil, code, err
+		}
+
+		if dryRun {
+			return data, http.StatusOK, nil
+		}
+
+		seen[path] = true
+		if code, err := c.applyPolicies(ctx, rt, vars, path, seen); err != nil {
+			return nil, code, err
+		}
+
+		code, err = c.drop(ctx, rt, vars, path, data, index, prevIndex)
+		if code == http.StatusPreconditionFailed && c.keyed(rt) && prevIndex == 0 && !mustExist && retry < maxRetries {
+			log.Infof("Document modified while deleting, retry: %s", path)
+			continue
+		}
+
+		if err != nil {
+			return nil, code, err
+		}
+
+		return data, http.StatusOK, nil
+	}
+}
+
+// cascade delete a resource that depends on a resource that is deleted and
+// apply the policies of the resources that depend on it in turn.
+func (c *config) cascade(ctx context.Context, rt *route, vars map[string]string, seen map[string]bool) (int, error) {
+	path := c.render(rt.resource, vars)
+	seen[path] = true
+
+	for retry := 0; ; retry++ {
+		data, index, code, err := c.get(ctx, rt, path, false)
+		if code == http.StatusNotFound {
+			return http.StatusOK, nil
+		}
+		if err != nil {
+			return code, err
+		}
+
+		if code, err := c.applyPolicies(ctx, rt, vars, path, seen); err != nil {
+			return code, err
+		}
+
+		code, err = c.drop(ctx, rt, vars, path, data, index, 0)
+		if code == http.StatusPreconditionFailed && c.keyed(rt) && retry < maxRetries {
+			log.Infof("Document modified while deleting, retry: %s", path)
+			continue
+		}
+
+		if err != nil && code != http.StatusNotFound {
+			return code, err
+		}
+		return http.StatusOK, nil
+	}
+}
+
+// drop delete a document read at an index, with the keys outside it in the same write.
+func (c *config) drop(ctx context.Context, rt *route, vars map[string]string, path string, data interface{}, index, prevIndex uint64) (int, error) {
+	opts := &etcd.DeleteOptions{PrevIndex: prevIndex}
+	if c.keyed(rt) {
+		c.deleteKeys(rt, vars, path, data, opts)
+		opts.PrevIndex = index
+	}
+	return c.session.Delete(ctx, path, opts)
+}
+
+// removed returns the documents of other routes stored inside a document that
+// are left out of the new document, the documents stored inside them are
+// removed with them the same way as a delete.
+func (c *config) removed(rt *route, vars map[string]string, path string, old, data interface{}) []nestedDoc {
+	kept := map[string]bool{}
+	var walk func(l []nestedDoc)
+	walk = func(l []nestedDoc) {
+		for _, n := range l {
+			kept[n.path] = true
+			walk(c.nestedDocs(n.rt, n.vars, n.path, n.doc))
+		}
+	}
+	walk(c.nestedDocs(rt, vars, path, data))
+
+	l := []nestedDoc{}
+	var find func(docs []nestedDoc)
+	find = func(docs []nestedDoc) {
+		for _, n := range docs {
+			if !kept[n.path] {
+				l = append(l, n)
+				continue
+			}
+			find(c.nestedDocs(n.rt, n.vars, n.path, n.doc))
+		}
+	}
+	find(c.nestedDocs(rt, vars, path, old))
+	return l
+}
+
+// dropNested check and apply the policies of the resources that depend on the
+// documents removed from a document that is written, a dry run only checks them.
+func (c *config) dropNested(ctx context.Context, docs []nestedDoc, dryRun bool) (int, error) {
+	seen := map[string]bool{}
+	for _, d := range docs {
+		seen[d.path] = true
+	}
+
+	if code, err := c.checkPolicies(ctx, docs, seen); err != nil {
+		return code, err
+	}
+	if dryRun {
+		return http.StatusOK, nil
+	}
+
+	for _, d := range docs {
+		if code, err := c.applyPolicies(ctx, d.rt, d.vars, d.path, seen); err != nil {
+			return code, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// nullify set the references to a deleted resource in a document to null, a
+// dry run only checks that the document is still valid.
+func (c *config) nullify(ctx context.Context, rt *route, vars map[string]string, path string, fields []string, id string, dryRun bool) (int, error) {
+	for retry := 0; ; retry++ {
+		old, index, code, err := c.get(ctx, rt, path, false)
+		if code == http.StatusNotFound {
+			return http.StatusOK, nil
+		}
+		if err != nil {
+			return code, err
+		}
+
+		// Copy the document so the old keys can be compared.
+		b, _ := json.Marshal(old)
+		var data interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		for _, f := range fields {
+			data = without(data, strings.Split(f, "."), id)
+		}
+
+		doc, err := json.Marshal(data)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if _, errors := c.validateDoc(doc, path, rt.schema); errors != nil {
+			return http.StatusConflict, fmt.Errorf("reference can't be removed: %s", errors[0].Error())
+		}
+
+		opts := &etcd.PutOptions{PrevIndex: index}
+		if err := c.putKeys(rt, vars, path, old, data, opts); err != nil {
+			return http.StatusConflict, fmt.Errorf("reference can't be removed: %s", err.Error())
+		}
+		if dryRun {
+			return http.StatusOK, nil
+		}
+		if rt.storage == StorageBlob {
+			code, err = c.session.PutBlob(ctx, path, doc, opts)
+		} else {
+			code, err = c.session.Put(ctx, path, data, opts)
+		}
+		if code == http.StatusPreconditionFailed && retry < maxRetries {
+			log.Infof("Document modified while writing, retry: %s", path)
+			continue
+		}
+		if err != nil {
+			return code, c.conflict(err)
+		}
+		return http.StatusOK, nil
+	}
+}
+
+// without returns a document with the values of a field that are equal to
+// the value removed set to null and the elements of an array equal to it left
+// out, "*" matches every value of an object or element of an array.
+func without(doc interface{}, path []string, value string) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if path[0] != "*" && path[0] != k {
+				continue
+			}
+			if len(path) > 1 {
+				v[k] = without(e, path[1:], value)
+			} else if s, ok := valueString(e); ok && s == value {
+				v[k] = nil
+			}
+		}
+	case []interface{}:
+		l := []interface{}{}
+		for i, e := range v {
+			switch {
+			case path[0] != "*" && path[0] != strconv.Itoa(i):
+				l = append(l, e)
+			case len(path) > 1:
+				l = append(l, without(e, path[1:], value))
+			default:
+				if s, ok := valueString(e); !ok || s != value {
+					l = append(l, e)
+				}
+			}
+		}
+		return l
+	}
+	return doc
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// maxRefs is the number of $ref followed before giving up on a reference loop.
+const maxRefs = 32
+
+// schemaTimeout is the time to read a schema file from an HTTP schema URI.
+const schemaTimeout = 10 * time.Second
+
+// schemaClient reads schema files from an HTTP schema URI.
+var schemaClient = &http.Client{Timeout: schemaTimeout}
+
+// schemaCache keeps compiled schemas and schema files until the config is reloaded.
+type schemaCache struct {
+	sync.RWMutex
+	compiled map[string]*gojsonschema.Schema
+	files    map[string]map[string]interface{}
+}
+
+// newSchemaCache returns an empty schema cache.
+func newSchemaCache() *schemaCache {
+	return &schemaCache{
+		compiled: map[string]*gojsonschema.Schema{},
+		files:    map[string]map[string]interface{}{},
+	}
+}
+
+// compile a schema and the schemas it references.
+func (c *config) compile(name string) (*gojsonschema.Schema, error) {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader(c.schemaURI + "/" + name))
+	if err != nil {
+		return nil, fmt.Errorf("can't load schema: %s: %s", name, err.Error())
+	}
+	return s, nil
+}
+
+// schema returns a compiled schema, it's compiled the first time it's used
+// unless it was compiled when the schemas were loaded.
+func (c *config) schema(name string) (*gojsonschema.Schema, error) {
+	c.schemas.RLock()
+	s, ok := c.schemas.compiled[name]
+	c.schemas.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	s, err := c.compile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.schemas.Lock()
+	c.schemas.compiled[name] = s
+	c.schemas.Unlock()
+	return s, nil
+}
+
+// loadSchemas compile the schemas of every route, the cache is only replaced
+// if all of them compile.
+func (c *config) loadSchemas() error {
+	compiled := map[string]*gojsonschema.Schema{}
+	for _, rt := range c.routes {
+		if _, ok := compiled[rt.schema]; ok {
+			continue
+		}
+
+		s, err := c.compile(rt.schema)
+		if err != nil {
+			return err
+		}
+		compiled[rt.schema] = s
+	}
+
+	c.schemas.Lock()
+	c.schemas.compiled = compiled
+	c.schemas.files = map[string]map[string]interface{}{}
+	c.schemas.Unlock()
+	return nil
+}
+
+// schemaExists check that a schema file exists under the schema URI, it's
+// checked before a schema named by a client is compiled and kept.
+func (c *config) schemaExists(name string) (int, error) {
+	uri := c.schemaURI + "/" + name
+
+	if strings.HasPrefix(uri, "file://") {
+		fi, err := os.Stat(strings.TrimPrefix(uri, "file://"))
+		switch {
+		case os.IsNotExist(err) || err == nil && fi.IsDir():
+			return http.StatusNotFound, fmt.Errorf("schema not found: %s", name)
+		case err != nil:
+			return http.StatusInternalServerError, fmt.Errorf("can't load schema: %s: %s", name, err.Error())
+		}
+		return http.StatusOK, nil
+	}
+
+	res, err := schemaClient.Head(uri)
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("can't load schema: %s: %s", name, err.Error())
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return http.StatusNotFound, fmt.Errorf("schema not found: %s", name)
+	case res.StatusCode != http.StatusOK:
+		return http.StatusBadGateway, fmt.Errorf("can't load schema: %s: %s", name, res.Status)
+	}
+	return http.StatusOK, nil
+}
+
+// schemaFile read a JSON schema file from the schema URI, files are kept
+// until the schemas are reloaded.
+func (c *config) schemaFile(name string) (map[string]interface{}, error) {
+	c.schemas.RLock()
+	s, ok := c.schemas.files[name]
+	c.schemas.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	uri := c.schemaURI + "/" + name
+
+	var b []byte
+	var err error
+	if strings.HasPrefix(uri, "file://") {
+		b, err = ioutil.ReadFile(strings.TrimPrefix(uri, "file://"))
+	} else {
+		var res *http.Response
+		if res, err = schemaClient.Get(uri); err == nil {
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("can't load schema: %s: %s", name, res.Status)
+			}
+			b, err = ioutil.ReadAll(res.Body)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't load schema: %s: %s", name, err.Error())
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("can't load schema: %s: %s", name, err.Error())
+	}
+
+	c.schemas.Lock()
+	c.schemas.files[name] = s
+	c.schemas.Unlock()
+	return s, nil
+}
+
+// resolve follow the $ref of a schema, a reference is relative to the file of
+// the schema that has it. The schema and the file it's in are returned.
+func (c *config) resolve(file string, s map[string]interface{}) (string, map[string]interface{}, error) {
+	for i := 0; i < maxRefs; i++ {
+		ref, ok := s["$ref"].(string)
+		if !ok {
+			return file, s, nil
+		}
+
+		name, pointer := ref, ""
+		if j := strings.Index(ref, "#"); j >= 0 {
+			name, pointer = ref[:j], ref[j+1:]
+		}
+		if name != "" {
+			file = path.Join(path.Dir(file), name)
+		}
+
+		doc, err := c.schemaFile(file)
+		if err != nil {
+			return "", nil, err
+		}
+
+		v, err := jsonPointer(doc, pointer)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %s", ref, err.Error())
+		}
+		if s, ok = v.(map[string]interface{}); !ok {
+			return "", nil, fmt.Errorf("%s: not a schema", ref)
+		}
+	}
+	return "", nil, fmt.Errorf("too many references: %s", file)
+}
+
+// jsonPointer returns the value a JSON pointer (RFC 6901) points to.
+func jsonPointer(doc interface{}, pointer string) (interface{}, error) {
+	if pointer == "" {
+		return doc, nil
+	}
+
+	for _, k := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		k = strings.Replace(strings.Replace(k, "~1", "/", -1), "~0", "~", -1)
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			e, ok := v[k]
+			if !ok {
+				return nil, fmt.Errorf("pointer not found: %s", pointer)
+			}
+			doc = e
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("pointer not found: %s", pointer)
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("pointer not found: %s", pointer)
+		}
+	}
+	return doc, nil
+}
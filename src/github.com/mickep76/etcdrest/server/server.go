@@ -2,13 +2,16 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 
 	"github.com/evanphx/json-patch"
 	"github.com/gorilla/handlers"
@@ -20,8 +23,9 @@ import (
 	"github.com/mickep76/etcdrest/log"
 )
 
-var session etcd.Session
-var templ *template.Template
+// maxRetries is the number of times a patch is reapplied when the document
+// is modified concurrently.
+const maxRetries = 5
 
 // Config interface.
 type Config interface {
@@ -31,35 +35,103 @@ type Config interface {
 	ServerURI(string) Config
 	Envelope(bool) Config
 	Indent(bool) Config
-	RouteEtcd(string, string, string, string, string, string)
+	OpenAPI(string) Config
+	Version(string) Config
+	RouteEtcd(string, string, string, string, string, string) Route
 	RouteTemplate(string, string)
 	RouteStatic(string, string)
+	Admin(string, Admin) Config
 	Run() error
+	Reload(Config) error
+}
+
+// Route interface.
+type Route interface {
+	Storage(string) Route
+	IDStrategy(string) Route
+	Indexes([]string) Route
+	Unique([]string) Route
+	Parent(string, string) Route
+	Reference(string, string, string) Route
 }
 
 // config struct.
 type config struct {
-	templDir  string
-	schemaURI string
-	bind      string
-	serverURI string
-	envelope  bool
-	indent    bool
-	session   etcd.Session
-	router    *mux.Router
+	templDir        string
+	schemaURI       string
+	bind            string
+	serverURI       string
+	envelope        bool
+	indent          bool
+	session         etcd.Session
+	openAPIEndpoint string
+	version         string
+	router          *mux.Router
+	routes          map[string]*route
+	schemas         *schemaCache
+	templRoutes     map[string]string
+	statics         []static
+	templ           *template.Template
+	templates       *template.Template
+	err             error
+	active          atomic.Value
 }
 
+// route struct.
+type route struct {
+	collection     string
+	collectionPath string
+	resource       string
+	resourcePath   string
+	schema         string
+	dirName        string
+	storage        string
+	idStrategy     string
+	idVar          string
+	resourceRoute  *mux.Route
+	indexes        []string
+	unique         []string
+	parent         string
+	onDelete       string
+	references     []reference
+}
+
+// static is the endpoint of a static route and the directory it serves.
+type static struct {
+	endpoint string
+	path     string
+}
+
+// Storage modes for documents.
+const (
+	StorageTree = "tree"
+	StorageBlob = "blob"
+)
+
 // New config constructor.
 func New(session etcd.Session) Config {
-	return &config{
-		templDir:  "templates",
-		schemaURI: "file://schemas",
-		bind:      "0.0.0.0:8080",
-		envelope:  false,
-		indent:    true,
-		session:   session,
-		router:    mux.NewRouter(),
+	c := &config{
+		templDir:        "templates",
+		schemaURI:       "file://schemas",
+		bind:            "0.0.0.0:8080",
+		envelope:        false,
+		indent:          true,
+		openAPIEndpoint: "/_openapi.json",
+		session:         session,
+		router:          mux.NewRouter(),
+		routes:          map[string]*route{},
+		schemas:         newSchemaCache(),
+		templ:           template.New("paths"),
+		templRoutes:     map[string]string{},
 	}
+
+	c.router.HandleFunc("/_validate/{schema:.+}", c.validate).Methods("POST")
+
+	// The OpenAPI endpoint is matched before the routes, it can be set until the config is served.
+	c.router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return c.openAPIEndpoint != "" && r.URL.Path == c.openAPIEndpoint
+	}).Methods("GET").HandlerFunc(c.getOpenAPI)
+	return c
 }
 
 func (c *config) TemplDir(templDir string) Config {
@@ -92,7 +164,69 @@ func (c *config) Indent(indent bool) Config {
 	return c
 }
 
-func (c *config) patchDoc(doc, patch []byte) ([]byte, error) {
+func (c *config) OpenAPI(endpoint string) Config {
+	c.openAPIEndpoint = endpoint
+	return c
+}
+
+func (c *config) Version(version string) Config {
+	c.version = version
+	return c
+}
+
+func (rt *route) Storage(storage string) Route {
+	rt.storage = storage
+	return rt
+}
+
+func (rt *route) IDStrategy(idStrategy string) Route {
+	rt.idStrategy = idStrategy
+	return rt
+}
+
+func (rt *route) Indexes(indexes []string) Route {
+	rt.indexes = indexes
+	return rt
+}
+
+func (rt *route) Unique(unique []string) Route {
+	rt.unique = unique
+	return rt
+}
+
+func (rt *route) Parent(parent, onDelete string) Route {
+	rt.parent = parent
+	if onDelete != "" {
+		rt.onDelete = onDelete
+	}
+	return rt
+}
+
+func (rt *route) Reference(field, route, onDelete string) Route {
+	if onDelete == "" {
+		onDelete = OnDeleteRestrict
+	}
+	rt.references = append(rt.references, reference{field: field, route: route, onDelete: onDelete})
+	return rt
+}
+
+// get document using the storage mode of the route.
+func (c *config) get(ctx context.Context, rt *route, path string, table bool) (interface{}, uint64, int, error) {
+	if rt.storage == StorageBlob {
+		return c.session.GetBlob(ctx, path, table, rt.dirName)
+	}
+	return c.session.Get(ctx, path, table, rt.dirName)
+}
+
+// mimeMergePatch is the content type of a JSON merge patch, any other patch is a JSON patch.
+const mimeMergePatch = "application/merge-patch+json"
+
+func (c *config) patchDoc(contentType string, doc, patch []byte) ([]byte, error) {
+	// Apply JSON merge patch.
+	if t, _, err := mime.ParseMediaType(contentType); err == nil && t == mimeMergePatch {
+		return jsonpatch.MergePatch(doc, patch)
+	}
+
 	// Prepare JSON patch.
 	p, err := jsonpatch.DecodePatch(patch)
 	if err != nil {
@@ -104,15 +238,17 @@ func (c *config) patchDoc(doc, patch []byte) ([]byte, error) {
 }
 
 func (c *config) validateDoc(doc []byte, path string, schema string) (int, []error) {
-	// Prepare document and JSON schema.
-	docLoader := gojsonschema.NewStringLoader(string(doc))
-	log.Infof("Using schema URI: %s/%s", c.schemaURI, schema)
-	schemaLoader := gojsonschema.NewReferenceLoader(c.schemaURI + "/" + schema)
+	// A schema that can't be loaded is an error of the server, not of the document.
+	s, err := c.schema(schema)
+	if err != nil {
+		log.Infof("Failed to load schema: %s", err.Error())
+		return http.StatusInternalServerError, []error{err}
+	}
 
 	// Validate document using JSON schema.
-	res, err := gojsonschema.Validate(schemaLoader, docLoader)
+	res, err := s.Validate(gojsonschema.NewStringLoader(string(doc)))
 	if err != nil {
-		return http.StatusInternalServerError, []error{err}
+		return http.StatusBadRequest, []error{fmt.Errorf("invalid JSON: %s", err.Error())}
 	}
 
 	if !res.Valid() {
@@ -128,11 +264,11 @@ func (c *config) validateDoc(doc []byte, path string, schema string) (int, []err
 }
 
 // putOrPatchDoc put or patch document.
-func (c *config) putOrPatchDoc(endpoint, path, schema string) func(w http.ResponseWriter, r *http.Request) {
+func (c *config) putOrPatchDoc(rt *route) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var newPath bytes.Buffer
 
-		err := templ.ExecuteTemplate(&newPath, endpoint, mux.Vars(r))
+		err := c.templ.ExecuteTemplate(&newPath, rt.resource, mux.Vars(r))
 		if err != nil {
 			log.Fatal(err.Error())
 		}
@@ -150,98 +286,231 @@ func (c *config) putOrPatchDoc(endpoint, path, schema string) func(w http.Respon
 			return
 		}
 
-		// Patch document using JSON patch RFC 6902.
-		var doc []byte
-		if r.Method == "PATCH" {
-			data, code, err := c.session.Get(newPath.String(), false, "")
-			if err != nil {
-				c.writeError(w, r, err, code)
+		// Convert a YAML or TOML body to JSON.
+		body, contentType, err := bodyJSON(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			c.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		// Get conditions, If-None-Match: * means the document must not exist.
+		prevIndex, mustExist, err := ifMatch(r)
+		if err != nil {
+			c.writeError(w, r, err, http.StatusPreconditionFailed)
+			return
+		}
+		prevNoExist := r.Header.Get("If-None-Match") == "*"
+
+		for retry := 0; ; retry++ {
+			opts := &etcd.PutOptions{PrevIndex: prevIndex, PrevNoExist: prevNoExist}
+
+			// The current document is needed to patch it, check conditions, update indexes and constraints
+			// or find the documents of other routes removed from it. A dry run checks the conditions the
+			// write would.
+			var doc []byte
+			var old interface{}
+			if r.Method == "PATCH" || mustExist || c.keyed(rt) || c.nests(rt) || (dryRun(r) && (prevIndex != 0 || prevNoExist)) {
+				data, index, code, err := c.get(r.Context(), rt, newPath.String(), false)
+				switch {
+				case code == http.StatusNotFound && r.Method != "PATCH" && !mustExist:
+					// Only write if the document still doesn't exist.
+					opts.PrevNoExist = true
+				case err != nil:
+					if code == http.StatusNotFound && mustExist {
+						code = http.StatusPreconditionFailed
+					}
+					c.writeError(w, r, err, code)
+					return
+				default:
+					// Only write if the document is unchanged since it was read.
+					if code, err := checkIndex(newPath.String(), index, prevIndex, prevNoExist); err != nil {
+						c.writeError(w, r, err, code)
+						return
+					}
+					opts.PrevIndex = index
+					old = data
+				}
+
+				// Patch document using JSON patch RFC 6902 or JSON merge patch RFC 7396.
+				if r.Method == "PATCH" {
+					origDoc, err := json.Marshal(&data)
+					if err != nil {
+						c.writeError(w, r, err, http.StatusInternalServerError)
+						return
+					}
+
+					doc, err = c.patchDoc(contentType, origDoc, body)
+					if err != nil {
+						c.writeError(w, r, err, http.StatusBadRequest)
+						return
+					}
+				}
+			}
+			if r.Method != "PATCH" {
+				doc = body
+			}
+
+			// Fill in defaults of the schema.
+			if doc, err = c.withDefaults(doc, rt.schema); err != nil {
+				c.writeError(w, r, err, http.StatusInternalServerError)
 				return
 			}
 
-			origDoc, err := json.Marshal(&data)
-			if err != nil {
+			// Validate document using JSON schema
+			if code, errors := c.validateDoc(doc, newPath.String(), rt.schema); errors != nil {
+				c.writeErrors(w, r, errors, code)
+				return
+			}
+
+			var data interface{}
+			if err := json.Unmarshal(doc, &data); err != nil {
 				c.writeError(w, r, err, http.StatusInternalServerError)
 				return
 			}
 
-			doc, err = c.patchDoc(origDoc, body)
-			if err != nil {
+			// The parent and referenced resources must exist.
+			if code, err := c.checkReferences(r.Context(), rt, mux.Vars(r), data); err != nil {
 				c.writeError(w, r, err, code)
 				return
 			}
-		} else {
-			doc = body
-		}
 
-		// Validate document using JSON schema
-		if code, errors := c.validateDoc(doc, newPath.String(), schema); errors != nil {
-			c.writeErrors(w, r, errors, code)
-			return
-		}
+			// Check the policies of the resources that depend on documents of other routes removed from it,
+			// they're applied once the document is written.
+			removed := c.removed(rt, mux.Vars(r), newPath.String(), old, data)
+			if len(removed) > 0 {
+				if code, err := c.dropNested(r.Context(), removed, true); err != nil {
+					c.writeError(w, r, err, code)
+					return
+				}
+			}
 
-		var data interface{}
-		if err := json.Unmarshal(doc, &data); err != nil {
-			c.writeError(w, r, err, http.StatusInternalServerError)
-			return
-		}
+			// Return the document that would be written.
+			if dryRun(r) {
+				c.write(w, r, data)
+				return
+			}
 
-		// Create document.
-		if code, err := c.session.Put(newPath.String(), data); err != nil {
-			c.writeError(w, r, err, code)
+			// Update indexes and references and claim unique values in the same write.
+			if c.keyed(rt) {
+				if err := c.putKeys(rt, mux.Vars(r), newPath.String(), old, data, opts); err != nil {
+					c.writeError(w, r, err, http.StatusConflict)
+					return
+				}
+			}
+
+			// Create document.
+			var code int
+			if rt.storage == StorageBlob {
+				code, err = c.session.PutBlob(r.Context(), newPath.String(), doc, opts)
+			} else {
+				code, err = c.session.Put(r.Context(), newPath.String(), data, opts)
+			}
+
+			// Patch the new document or update indexes again if it was modified by someone else and no condition was given.
+			if code == http.StatusPreconditionFailed && (r.Method == "PATCH" || c.keyed(rt) || c.nests(rt)) && prevIndex == 0 && !mustExist && !prevNoExist && retry < maxRetries {
+				log.Infof("Document modified while writing, retry: %s", newPath.String())
+				continue
+			}
+
+			if err != nil {
+				c.writeError(w, r, c.conflict(err), code)
+				return
+			}
+
+			if len(removed) > 0 {
+				if code, err := c.dropNested(r.Context(), removed, false); err != nil {
+					c.writeError(w, r, fmt.Errorf("document written, but the resources depending on what was removed from it weren't updated: %s", err.Error()), code)
+					return
+				}
+			}
+
+			c.write(w, r, data)
 			return
 		}
+	}
+}
 
-		c.write(w, r, data)
+// checkIndex checks the conditions of a write against the index of the document that was read.
+func checkIndex(path string, index, prevIndex uint64, prevNoExist bool) (int, error) {
+	if prevNoExist {
+		return http.StatusPreconditionFailed, fmt.Errorf("document already exists: %s", path)
 	}
+
+	if prevIndex != 0 && index != prevIndex {
+		return http.StatusPreconditionFailed, fmt.Errorf("document has been modified: %s", path)
+	}
+
+	return http.StatusOK, nil
 }
 
 // getDoc get document.
-func (c *config) getDoc(endpoint, path string, collection bool, dirName string) func(w http.ResponseWriter, r *http.Request) {
+func (c *config) getDoc(rt *route, collection bool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var newPath bytes.Buffer
 
+		endpoint := rt.resource
+		if collection {
+			endpoint = rt.collection
+		}
+
 		table := false
 		if collection == true && strings.ToLower(r.URL.Query().Get("table")) == "true" {
 			table = true
 		}
 
-		err := templ.ExecuteTemplate(&newPath, endpoint, mux.Vars(r))
+		err := c.templ.ExecuteTemplate(&newPath, endpoint, mux.Vars(r))
 		if err != nil {
 			log.Fatal(err.Error())
 		}
 
 		log.Infof("etcd path: %s", newPath.String())
 
-		doc, code, err := c.session.Get(newPath.String(), table, dirName)
+		if strings.ToLower(r.URL.Query().Get("watch")) == "true" {
+			c.watchDoc(w, r, rt, newPath.String(), collection)
+			return
+		}
+
+		if collection && paged(r) {
+			c.getPage(w, r, rt, newPath.String(), table)
+			return
+		}
+
+		doc, index, code, err := c.get(r.Context(), rt, newPath.String(), table)
 		if err != nil {
 			c.writeError(w, r, err, code)
 			return
 		}
 
+		// Entity tag for a resource is the etcd index it was last modified at.
+		if !collection {
+			w.Header().Set("ETag", etag(index))
+			if ifNoneMatch(r, index) {
+				varyAccept(w)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		if table {
+			c.writeTable(w, r, rt, doc, http.StatusOK, nil)
+			return
+		}
+
 		c.write(w, r, doc)
 	}
 }
 
 // deleteDoc delete document.
-func (c *config) deleteDoc(endpoint, path string) func(w http.ResponseWriter, r *http.Request) {
+func (c *config) deleteDoc(rt *route) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var newPath bytes.Buffer
-
-		err := templ.ExecuteTemplate(&newPath, endpoint, mux.Vars(r))
+		prevIndex, mustExist, err := ifMatch(r)
 		if err != nil {
-			log.Fatal(err.Error())
-		}
-
-		log.Infof("etcd path: %s", newPath.String())
-
-		data, code, err := c.session.Get(newPath.String(), false, "")
-		if err != nil {
-			c.writeError(w, r, err, code)
+			c.writeError(w, r, err, http.StatusPreconditionFailed)
 			return
 		}
 
-		if code, err := c.session.Delete(newPath.String()); err != nil {
+		data, code, err := c.remove(r.Context(), rt, mux.Vars(r), prevIndex, mustExist, dryRun(r), map[string]bool{})
+		if err != nil {
 			c.writeError(w, r, err, code)
 			return
 		}
@@ -251,39 +520,118 @@ func (c *config) deleteDoc(endpoint, path string) func(w http.ResponseWriter, r
 }
 
 // RouteEtcd add route for etcd.
-func (c *config) RouteEtcd(collection, collectionPath, resource, resourcePath, schema, dirName string) {
+func (c *config) RouteEtcd(collection, collectionPath, resource, resourcePath, schema, dirName string) Route {
 	log.Infof("Add collection: %s collection path: %s", collection, collectionPath)
 	log.Infof("Add resource: %s resource path: %s schema: %s", resource, resourcePath, schema)
 
-	if templ == nil {
-		templ = template.Must(template.New(collection).Parse(collectionPath))
-	} else {
-		template.Must(templ.New(collection).Parse(collectionPath))
+	c.parse(collection, collectionPath)
+	c.parse(resource, resourcePath)
+
+	rt := &route{
+		collection:     collection,
+		collectionPath: collectionPath,
+		resource:       resource,
+		resourcePath:   resourcePath,
+		schema:         schema,
+		dirName:        dirName,
+		storage:        StorageTree,
+		idStrategy:     IDUUID,
+		idVar:          idVar(collection, resource),
+		onDelete:       OnDeleteRestrict,
 	}
+	c.routes[resource] = rt
 
-	template.Must(templ.New(resource).Parse(resourcePath))
+	c.router.HandleFunc(collection, c.getDoc(rt, true)).Methods("GET")
+	rt.resourceRoute = c.router.HandleFunc(resource, c.getDoc(rt, false)).Methods("GET")
+	c.router.HandleFunc(resource, c.putOrPatchDoc(rt)).Methods("PUT")
+	c.router.HandleFunc(resource, c.putOrPatchDoc(rt)).Methods("PATCH")
+	c.router.HandleFunc(resource, c.deleteDoc(rt)).Methods("DELETE")
 
-	c.router.HandleFunc(collection, c.getDoc(collection, collectionPath, true, dirName)).Methods("GET")
-	c.router.HandleFunc(resource, c.getDoc(resource, resourcePath, false, dirName)).Methods("GET")
-	c.router.HandleFunc(resource, c.putOrPatchDoc(resource, resourcePath, schema)).Methods("PUT")
-	c.router.HandleFunc(resource, c.putOrPatchDoc(resource, resourcePath, schema)).Methods("PATCH")
-	c.router.HandleFunc(resource, c.deleteDoc(resource, resourcePath)).Methods("DELETE")
+	// Resources with an ID can be created with a server-generated ID.
+	if rt.idVar != "" {
+		c.router.HandleFunc(collection, c.postDoc(rt)).Methods("POST")
+	}
+
+	return rt
 }
 
 // RouteStatic add route for file system path.
 func (c *config) RouteStatic(endpoint, path string) {
 	log.Infof("Add endpoint: %s path: %s", endpoint, path)
 
+	c.statics = append(c.statics, static{endpoint: endpoint, path: path})
 	c.router.PathPrefix(endpoint + "/").Handler(http.StripPrefix(endpoint+"/", http.FileServer(http.Dir(path))))
-	http.Handle(endpoint+"/", c.router)
+}
+
+// parse add a path template, the first error is returned when the config is prepared.
+func (c *config) parse(name, path string) {
+	if _, err := c.templ.New(name).Parse(path); err != nil && c.err == nil {
+		c.err = fmt.Errorf("%s: %s", name, err.Error())
+	}
+}
+
+// prepare check the routes and load the schemas and templates before the config is served.
+func (c *config) prepare() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if err := c.checkRelations(); err != nil {
+		return err
+	}
+
+	// Compile schemas before binding, so a broken schema fails fast.
+	if err := c.loadSchemas(); err != nil {
+		return err
+	}
+
+	if err := c.loadTemplates(); err != nil {
+		return err
+	}
+
+	// Keys of documents written before the route declared them.
+	if err := c.backfill(); err != nil {
+		return err
+	}
+
+	if c.openAPIEndpoint != "" {
+		log.Infof("Add OpenAPI endpoint: %s", c.openAPIEndpoint)
+	}
+	return nil
 }
 
 // Run server.
 func (c *config) Run() error {
-	session = c.session
+	if err := c.prepare(); err != nil {
+		return err
+	}
+	c.active.Store(c)
+
+	// Requests are served by the active config, it's replaced when the config is reloaded.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.active.Load().(*config).router.ServeHTTP(w, r)
+	})
 
 	log.Infof("Bind to: %s", c.bind)
 	log.Infof("Using server URI: %s", c.serverURI)
-	logr := handlers.LoggingHandler(os.Stderr, c.router)
+	logr := handlers.LoggingHandler(os.Stderr, handler)
 	return http.ListenAndServe(c.bind, logr)
 }
+
+// Reload replace the routes and settings of a running server with those of
+// another config that hasn't been run. Requests in progress finish with the
+// previous config, if the other config has a problem the previous is kept.
+func (c *config) Reload(next Config) error {
+	n, ok := next.(*config)
+	if !ok || n == c {
+		return fmt.Errorf("can't reload with the same config")
+	}
+
+	if err := n.prepare(); err != nil {
+		return err
+	}
+	c.active.Store(n)
+
+	log.Infof("Reloaded config")
+	return nil
+}
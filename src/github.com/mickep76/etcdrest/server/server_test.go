@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mickep76/etcdrest/etcd"
+)
+
+// schemas are the schema files of the test routes.
+var schemas = map[string]string{
+	"site.json":      `{"type": "object"}`,
+	"host.json":      `{"type": "object", "required": ["site"], "properties": {"site": {"type": "string"}, "serial": {"type": "string"}}}`,
+	"interface.json": `{"type": "object", "properties": {"ip": {"type": "string"}}}`,
+}
+
+// newTestServer returns a server on the memory backend with sites, hosts that
+// reference a site, have a unique serial and get etcd in-order IDs, and
+// interfaces of a host that are deleted with it. Each setup function can add
+// routes before the config is prepared.
+func newTestServer(t *testing.T, setup ...func(c *config)) *httptest.Server {
+	dir, err := ioutil.TempDir("", "etcdrest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, s := range schemas {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	es, err := etcd.New().Backend(etcd.BackendMemory).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(es).SchemaURI("file://" + dir).(*config)
+	c.RouteEtcd("/api/sites", "/sites", "/api/sites/{site}", "/sites/{{.site}}", "site.json", "site")
+	c.RouteEtcd("/api/hosts", "/hosts", "/api/hosts/{host}", "/hosts/{{.host}}", "host.json", "host").
+		IDStrategy(IDEtcd).
+		Unique([]string{"serial"}).
+		Reference("site", "/api/sites/{site}", OnDeleteRestrict)
+	c.RouteEtcd("/api/hosts/{host}/interfaces", "/hosts/{{.host}}/interfaces", "/api/hosts/{host}/interfaces/{interface}", "/hosts/{{.host}}/interfaces/{{.interface}}", "interface.json", "interface").
+		Parent("/api/hosts/{host}", OnDeleteCascade)
+	for _, f := range setup {
+		f(c)
+	}
+	if err := c.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(c.router)
+	t.Cleanup(func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	})
+	return ts
+}
+
+// do send a request and returns the response with the body read.
+func do(t *testing.T, ts *httptest.Server, method, path, body string, headers ...string) (*http.Response, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+// expect send a request and fails the test unless the response has the status code.
+func expect(t *testing.T, ts *httptest.Server, code int, method, path, body string, headers ...string) (*http.Response, string) {
+	res, b := do(t, ts, method, path, body, headers...)
+	if res.StatusCode != code {
+		t.Fatalf("%s %s: got %d, want %d: %s", method, path, res.StatusCode, code, b)
+	}
+	return res, b
+}
+
+func decodeBody(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid JSON: %s: %s", s, err.Error())
+	}
+	return v
+}
+
+func TestCRUD(t *testing.T) {
+	ts := newTestServer(t)
+
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{}`)
+	expect(t, ts, http.StatusOK, "PUT", "/api/hosts/a", `{"site": "sto1", "serial": "1"}`)
+
+	_, b := expect(t, ts, http.StatusOK, "GET", "/api/hosts/a", "")
+	if doc := decodeBody(t, b).(map[string]interface{}); doc["serial"] != "1" {
+		t.Errorf("GET after PUT: %s", b)
+	}
+
+	expect(t, ts, http.StatusOK, "PATCH", "/api/hosts/a", `{"serial": "2"}`, "Content-Type", "application/merge-patch+json")
+	_, b = expect(t, ts, http.StatusOK, "GET", "/api/hosts/a", "")
+	if doc := decodeBody(t, b).(map[string]interface{}); doc["serial"] != "2" || doc["site"] != "sto1" {
+		t.Errorf("GET after PATCH: %s", b)
+	}
+
+	_, b = expect(t, ts, http.StatusOK, "GET", "/api/hosts", "")
+	if docs := decodeBody(t, b).(map[string]interface{}); len(docs) != 1 || docs["a"] == nil {
+		t.Errorf("GET of collection: %s", b)
+	}
+
+	expect(t, ts, http.StatusBadRequest, "PUT", "/api/hosts/b", `{"serial": "3"}`)
+	expect(t, ts, http.StatusOK, "DELETE", "/api/hosts/a", "")
+	expect(t, ts, http.StatusNotFound, "GET", "/api/hosts/a", "")
+}
+
+func TestETag(t *testing.T) {
+	ts := newTestServer(t)
+
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{}`)
+	res, _ := expect(t, ts, http.StatusOK, "GET", "/api/sites/sto1", "")
+	tag := res.Header.Get("ETag")
+	if tag == "" {
+		t.Fatal("GET has no ETag")
+	}
+
+	expect(t, ts, http.StatusNotModified, "GET", "/api/sites/sto1", "", "If-None-Match", tag)
+	expect(t, ts, http.StatusPreconditionFailed, "PUT", "/api/sites/sto1", `{"name": "x"}`, "If-Match", `"999"`)
+	expect(t, ts, http.StatusPreconditionFailed, "PUT", "/api/sites/sto1?dryRun=true", `{"name": "x"}`, "If-Match", `"999"`)
+	expect(t, ts, http.StatusPreconditionFailed, "PUT", "/api/sites/sto1?dryRun=true", `{}`, "If-None-Match", "*")
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1?dryRun=true", `{"name": "x"}`, "If-Match", tag)
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{"name": "x"}`, "If-Match", tag)
+
+	// The tag has changed with the write.
+	expect(t, ts, http.StatusPreconditionFailed, "DELETE", "/api/sites/sto1", "", "If-Match", tag)
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto2", `{}`, "If-None-Match", "*")
+	expect(t, ts, http.StatusPreconditionFailed, "PUT", "/api/sites/sto2", `{}`, "If-None-Match", "*")
+}
+
+func TestUnique(t *testing.T) {
+	ts := newTestServer(t)
+
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{}`)
+	expect(t, ts, http.StatusOK, "PUT", "/api/hosts/a", `{"site": "sto1", "serial": "1"}`)
+	expect(t, ts, http.StatusConflict, "PUT", "/api/hosts/b", `{"site": "sto1", "serial": "1"}`)
+
+	// The value is released when it's changed or the resource is deleted.
+	expect(t, ts, http.StatusOK, "PUT", "/api/hosts/a", `{"site": "sto1", "serial": "2"}`)
+	expect(t, ts, http.StatusOK, "PUT", "/api/hosts/b", `{"site": "sto1", "serial": "1"}`)
+	expect(t, ts, http.StatusOK, "DELETE", "/api/hosts/a", "")
+	expect(t, ts, http.StatusOK, "PUT", "/api/hosts/c", `{"site": "sto1", "serial": "2"}`)
+}
+
+func TestDeletePolicies(t *testing.T) {
+	ts := newTestServer(t)
+
+	expect(t, ts, http.StatusUnprocessableEntity, "PUT", "/api/hosts/a", `{"site": "sto1"}`)
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{}`)
+	expect(t, ts, http.StatusOK, "PUT", "/api/hosts/a", `{"site": "sto1"}`)
+	expect(t, ts, http.StatusOK, "PUT", "/api/hosts/a/interfaces/eth0", `{"ip": "10.0.0.1"}`)
+
+	// The host references the site.
+	expect(t, ts, http.StatusConflict, "DELETE", "/api/sites/sto1", "")
+
+	// Interfaces are deleted with their host, a dry run doesn't delete anything.
+	expect(t, ts, http.StatusOK, "DELETE", "/api/hosts/a?dryRun=true", "")
+	expect(t, ts, http.StatusOK, "GET", "/api/hosts/a/interfaces/eth0", "")
+	expect(t, ts, http.StatusOK, "DELETE", "/api/hosts/a", "")
+	expect(t, ts, http.StatusNotFound, "GET", "/api/hosts/a/interfaces/eth0", "")
+
+	expect(t, ts, http.StatusOK, "DELETE", "/api/sites/sto1", "")
+}
+
+func TestWatch(t *testing.T) {
+	ts := newTestServer(t)
+
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{}`)
+	res, _ := expect(t, ts, http.StatusOK, "GET", "/api/sites/sto1", "")
+	index := strings.Trim(res.Header.Get("ETag"), `"`)
+
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto2", `{"name": "b"}`)
+	expect(t, ts, http.StatusOK, "PUT", "/api/sites/sto1", `{"name": "a"}`)
+	expect(t, ts, http.StatusOK, "DELETE", "/api/sites/sto1", "")
+
+	// Resuming after each event returns every change in order.
+	for _, want := range []struct{ action, name string }{
+		{etcd.ActionPut, "sto2"},
+		{etcd.ActionPut, "sto1"},
+		{etcd.ActionDelete, "sto1"},
+	} {
+		_, b := expect(t, ts, http.StatusOK, "GET", "/api/sites?watch=true", "", "Last-Event-ID", index)
+		events := decodeBody(t, b).([]interface{})
+		if len(events) != 1 {
+			t.Fatalf("watch returned %d events: %s", len(events), b)
+		}
+		e := events[0].(map[string]interface{})
+		if e["action"] != want.action || e["name"] != want.name {
+			t.Fatalf("watch after %s returned: %s, want %s %s", index, b, want.action, want.name)
+		}
+		index = fmt.Sprint(e["index"])
+	}
+
+	expect(t, ts, http.StatusBadRequest, "GET", "/api/sites?watch=true&name=b", "")
+}
+
+func TestValidate(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, tc := range []struct {
+		schema, body string
+		code         int
+	}{
+		{"host.json", `{"site": "sto1"}`, http.StatusOK},
+		{"host.json", `{"serial": "1"}`, http.StatusBadRequest},
+		{"missing.json", `{}`, http.StatusNotFound},
+	} {
+		if res, b := do(t, ts, "POST", "/_validate/"+tc.schema, tc.body); res.StatusCode != tc.code {
+			t.Errorf("validate %s with %s: got %d, want %d: %s", tc.schema, tc.body, res.StatusCode, tc.code, b)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/robertkrimen/otto"
 
+	"github.com/mickep76/etcdrest/etcd"
 	"github.com/mickep76/etcdrest/log"
 )
 
@@ -79,24 +81,30 @@ func lastvaln(l ...string) string {
 	return lastval(l)
 }
 
-func get(path string) (interface{}, error) {
-	data, code, err := session.Get(path, false, "")
+// get returns a template function reading a document from etcd.
+func get(ctx context.Context, s etcd.Session) func(string) (interface{}, error) {
+	return func(path string) (interface{}, error) {
+		data, _, code, err := s.Get(ctx, path, false, "")
 
-	if code == http.StatusNotFound {
-		return nil, nil
-	}
+		if code == http.StatusNotFound {
+			return nil, nil
+		}
 
-	return data, err
+		return data, err
+	}
 }
 
-func getKeys(paths ...string) ([]string, error) {
-	arr, code, err := session.GetKeys(paths...)
+// getKeys returns a template function listing keys in etcd.
+func getKeys(ctx context.Context, s etcd.Session) func(...string) ([]string, error) {
+	return func(paths ...string) ([]string, error) {
+		arr, code, err := s.GetKeys(ctx, paths...)
 
-	if code == http.StatusNotFound {
-		return nil, nil
-	}
+		if code == http.StatusNotFound {
+			return nil, nil
+		}
 
-	return arr, err
+		return arr, err
+	}
 }
 
 func replace(oldStr string, newStr string, str string) string {
@@ -106,8 +114,6 @@ func replace(oldStr string, newStr string, str string) string {
 var funcs = template.FuncMap{
 	"center":    center,
 	"substr":    substr,
-	"get":       get,
-	"getkeys":   getKeys,
 	"lastval":   lastval,
 	"lastvaln":  lastvaln,
 	"replace":   replace,
@@ -116,21 +122,44 @@ var funcs = template.FuncMap{
 	"getsubnet": getSubnet,
 }
 
-var templates *template.Template
-var vm *otto.Otto
+var vm = otto.New()
 
-// RouteTempl add route for Go Text Template.
-func (c *config) RouteTemplate(endpoint, templ string) {
-	if templates == nil {
-		templates = template.Must(template.New("main").Funcs(funcs).ParseGlob(c.templDir + "/*.tmpl"))
-		vm = otto.New()
+// sessionFuncs returns the template functions that read from etcd, with the
+// context of a request.
+func (c *config) sessionFuncs(ctx context.Context) template.FuncMap {
+	return template.FuncMap{
+		"get":     get(ctx, c.session),
+		"getkeys": getKeys(ctx, c.session),
 	}
+}
 
+// RouteTempl add route for Go Text Template.
+func (c *config) RouteTemplate(endpoint, templ string) {
 	url := endpoint
 	log.Infof("Add endpoint: %s template: %s", url, templ)
+	c.templRoutes[url] = templ
 	c.router.HandleFunc(url, c.getTemplate(templ)).Methods("GET")
 }
 
+// loadTemplates parse the templates in the template directory, if there are template routes.
+func (c *config) loadTemplates() error {
+	if len(c.templRoutes) == 0 {
+		return nil
+	}
+
+	t, err := template.New("main").Funcs(funcs).Funcs(c.sessionFuncs(context.Background())).ParseGlob(c.templDir + "/*.tmpl")
+	if err != nil {
+		return err
+	}
+	for endpoint, name := range c.templRoutes {
+		if t.Lookup(name) == nil {
+			return fmt.Errorf("template not found: %s for endpoint: %s", name, endpoint)
+		}
+	}
+	c.templates = t
+	return nil
+}
+
 func (c *config) getTemplate(templ string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		input := map[string]interface{}{
@@ -139,9 +168,17 @@ func (c *config) getTemplate(templ string) func(w http.ResponseWriter, r *http.R
 			"server_uri": c.serverURI,
 		}
 
+		// Functions reading from etcd are cancelled with the request.
+		t, err := c.templates.Clone()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t.Funcs(c.sessionFuncs(r.Context()))
+
 		// Write template.
 		b := new(bytes.Buffer)
-		if err := templates.ExecuteTemplate(b, templ, input); err != nil {
+		if err := t.ExecuteTemplate(b, templ, input); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
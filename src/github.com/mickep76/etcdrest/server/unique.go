@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mickep76/etcdrest/etcd"
+)
+
+// uniquePrefix is the etcd path where unique constraint keys are stored, for
+// each field and value there is a key holding the path of the resource with
+// the value.
+const uniquePrefix = "/_etcdrest/unique"
+
+// uniqueDir returns the directory of the constraint keys of a route, it spans
+// every collection of a nested route.
+func (rt *route) uniqueDir() string {
+	return uniquePrefix + "/" + url.PathEscape(rt.collectionPath)
+}
+
+// uniqueKeys returns the constraint keys of a document.
+func (rt *route) uniqueKeys(path string, doc interface{}) map[string]string {
+	keys := map[string]string{}
+	if doc == nil {
+		return keys
+	}
+
+	for _, f := range rt.unique {
+		for _, v := range values(doc, strings.Split(f, ".")) {
+			keys[rt.uniqueDir()+"/"+url.PathEscape(f)+"/="+url.PathEscape(v)] = path
+		}
+	}
+	return keys
+}
+
+// uniqueChanges returns the constraint keys to claim and to release when a
+// document with the old keys is replaced by a document with the new keys.
+func uniqueChanges(oldKeys, newKeys map[string]string) (map[string]string, map[string]string) {
+	release := map[string]string{}
+	for k, v := range oldKeys {
+		if _, ok := newKeys[k]; !ok {
+			release[k] = v
+		}
+	}
+	return newKeys, release
+}
+
+// keyed returns true if writes to the route update keys outside the document.
+func (rt *route) keyed() bool {
+	return len(rt.indexes) > 0 || len(rt.unique) > 0 || len(rt.references) > 0
+}
+
+// routeOf returns the route of a unique constraint key.
+func (c *config) routeOf(key string) *route {
+	for _, rt := range c.routes {
+		if len(rt.unique) > 0 && strings.HasPrefix(key, rt.uniqueDir()+"/") {
+			return rt
+		}
+	}
+	return nil
+}
+
+// conflict returns the error for a value that is held by another resource.
+func (c *config) conflict(err error) error {
+	e, ok := err.(*etcd.ClaimError)
+	if !ok {
+		return err
+	}
+
+	rt := c.routeOf(e.Key)
+	if rt == nil {
+		return err
+	}
+
+	l := strings.SplitN(strings.TrimPrefix(e.Key, rt.uniqueDir()+"/"), "/=", 2)
+	if len(l) != 2 {
+		return err
+	}
+
+	f, _ := url.PathUnescape(l[0])
+	v, _ := url.PathUnescape(l[1])
+	return fmt.Errorf("value of %s is already used by %s: %s", f, e.Holder, v)
+}
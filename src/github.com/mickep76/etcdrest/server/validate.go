@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// dryRun returns true if a write should only be checked, not written.
+func dryRun(r *http.Request) bool {
+	return strings.ToLower(r.URL.Query().Get("dryRun")) == "true"
+}
+
+// validate check a document against a schema under the schema URI, the
+// document is returned if it's valid.
+func (c *config) validate(w http.ResponseWriter, r *http.Request) {
+	schema := mux.Vars(r)["schema"]
+	if strings.Contains("/"+schema+"/", "/../") {
+		c.writeError(w, r, fmt.Errorf("invalid schema: %s", schema), http.StatusBadRequest)
+		return
+	}
+
+	// Only schema files that exist are compiled and kept.
+	if code, err := c.schemaExists(schema); err != nil {
+		c.writeError(w, r, err, code)
+		return
+	}
+
+	// Get request body.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Convert a YAML or TOML body to JSON.
+	doc, _, err := bodyJSON(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		c.writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	// Fill in defaults of the schema.
+	if doc, err = c.withDefaults(doc, schema); err != nil {
+		c.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(doc, &data); err != nil {
+		c.writeError(w, r, fmt.Errorf("invalid JSON: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if code, errors := c.validateDoc(doc, "(root)", schema); errors != nil {
+		c.writeErrors(w, r, errors, code)
+		return
+	}
+
+	c.write(w, r, data)
+}
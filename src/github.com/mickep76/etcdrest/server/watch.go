@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mickep76/etcdrest/etcd"
+	"github.com/mickep76/etcdrest/log"
+)
+
+// longPollTimeout is the time a long-poll request waits for an event.
+const longPollTimeout = 60 * time.Second
+
+// watchDoc stream changes to a resource or the resources in a collection, as
+// server-sent events or as a long-poll request returning the first event.
+func (c *config) watchDoc(w http.ResponseWriter, r *http.Request, rt *route, path string, collection bool) {
+	// Events are sent for every resource, a subset of the collection can't be watched.
+	if paged(r) {
+		c.writeError(w, r, fmt.Errorf("watch can't be combined with limit, offset, cursor, sort, q, indexField or filters"), http.StatusBadRequest)
+		return
+	}
+
+	// Resume after index from either the query or the last event received.
+	var afterIndex uint64
+	idx := r.URL.Query().Get("index")
+	if idx == "" {
+		idx = r.Header.Get("Last-Event-ID")
+	}
+	if idx != "" {
+		i, err := strconv.ParseUint(idx, 10, 64)
+		if err != nil {
+			c.writeError(w, r, fmt.Errorf("invalid index: %s", idx), http.StatusBadRequest)
+			return
+		}
+		afterIndex = i
+	}
+
+	flusher, ok := w.(http.Flusher)
+	sse := ok && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	varyAccept(w)
+
+	// Stop watching when the client goes away or the long-poll times out.
+	ctx := r.Context()
+	if !sse {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, longPollTimeout)
+		defer cancel()
+	}
+
+	watcher := c.session.Watch(ctx, path, afterIndex)
+	defer watcher.Close()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+
+	// last is the index of the last event of each resource.
+	last := map[string]uint64{}
+	for {
+		ev, code, err := watcher.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				// Long-poll timed out without any event, or the client went away.
+				if !sse && r.Context().Err() == nil {
+					c.write(w, r, []interface{}{})
+				}
+				return
+			}
+
+			log.Infof("Watch failed: %s: %s", path, err.Error())
+			if sse {
+				fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+				flusher.Flush()
+				return
+			}
+
+			c.writeError(w, r, err, code)
+			return
+		}
+
+		// Find the resource the key belongs to.
+		docPath, name := path, path[strings.LastIndex(path, "/")+1:]
+		if collection {
+			rel := strings.TrimPrefix(ev.Key, path+"/")
+			if rel == ev.Key {
+				continue
+			}
+			name = strings.SplitN(rel, "/", 2)[0]
+			docPath = path + "/" + name
+		}
+
+		// Every key of a document changed by the same write has the same index.
+		if ev.Index == last[docPath] {
+			continue
+		}
+		last[docPath] = ev.Index
+
+		e := map[string]interface{}{
+			"action": etcd.ActionPut,
+			"path":   docPath,
+			"name":   name,
+			"index":  ev.Index,
+		}
+
+		// The document is read when the event is sent, it may have changed since,
+		// a key deleted by a write that kept the document is a put.
+		data, _, code, err := c.get(ctx, rt, docPath, false)
+		if err != nil && code != http.StatusNotFound {
+			if sse {
+				fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+				flusher.Flush()
+				return
+			}
+			c.writeError(w, r, err, code)
+			return
+		}
+
+		switch {
+		case ev.Action == etcd.ActionDelete && (ev.Key == docPath || err != nil):
+			e["action"] = etcd.ActionDelete
+		case err == nil:
+			e["data"] = data
+		}
+
+		if !sse {
+			c.write(w, r, []interface{}{e})
+			return
+		}
+
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Infof("Watch failed: %s: %s", path, err.Error())
+			return
+		}
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Index, e["action"], b)
+		flusher.Flush()
+	}
+}
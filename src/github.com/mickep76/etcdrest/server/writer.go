@@ -1,15 +1,21 @@
 package server
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 )
 
 func (c *config) write(w http.ResponseWriter, r *http.Request, data interface{}) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+	c.writeCode(w, r, data, http.StatusOK)
+}
+
+func (c *config) writeCode(w http.ResponseWriter, r *http.Request, data interface{}, code int) {
+	c.writeMeta(w, r, data, code, nil)
+}
 
+// writeMeta write data, metadata is added to the envelope.
+func (c *config) writeMeta(w http.ResponseWriter, r *http.Request, data interface{}, code int, meta map[string]interface{}) {
 	envelope := c.envelope
 	switch strings.ToLower(r.URL.Query().Get("envelope")) {
 	case "true":
@@ -19,21 +25,21 @@ func (c *config) write(w http.ResponseWriter, r *http.Request, data interface{})
 	}
 
 	if envelope == false {
-		c.writeMIME(w, r, data)
+		c.writeMIME(w, r, data, code)
 	} else {
 		e := map[string]interface{}{
-			"code": http.StatusOK,
+			"code": code,
 			"data": data,
 		}
+		for k, v := range meta {
+			e[k] = v
+		}
 
-		c.writeMIME(w, r, e)
+		c.writeMIME(w, r, e, code)
 	}
 }
 
 func (c *config) writeErrors(w http.ResponseWriter, r *http.Request, errors []error, code int) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(code)
-
 	envelope := c.envelope
 	switch strings.ToLower(r.URL.Query().Get("envelope")) {
 	case "true":
@@ -48,14 +54,14 @@ func (c *config) writeErrors(w http.ResponseWriter, r *http.Request, errors []er
 	}
 
 	if envelope == false {
-		c.writeMIME(w, r, s)
+		c.writeMIME(w, r, s, code)
 	} else {
 		e := map[string]interface{}{
 			"code": code,
 			"data": s,
 		}
 
-		c.writeMIME(w, r, e)
+		c.writeMIME(w, r, e, code)
 	}
 }
 
@@ -63,7 +69,8 @@ func (c *config) writeError(w http.ResponseWriter, r *http.Request, err error, c
 	c.writeErrors(w, r, []error{err}, code)
 }
 
-func (c *config) writeMIME(w http.ResponseWriter, r *http.Request, data interface{}) {
+// writeMIME write data in the format asked for by the request.
+func (c *config) writeMIME(w http.ResponseWriter, r *http.Request, data interface{}, code int) {
 	indent := c.indent
 	switch strings.ToLower(r.URL.Query().Get("indent")) {
 	case "true":
@@ -72,11 +79,21 @@ func (c *config) writeMIME(w http.ResponseWriter, r *http.Request, data interfac
 		indent = false
 	}
 
-	var b []byte
-	if indent == false {
-		b, _ = json.Marshal(data)
-	} else {
-		b, _ = json.MarshalIndent(data, "", "  ")
+	// Only tables are written as CSV, see writeTable.
+	format := responseFormat(r)
+	if format == formatCSV {
+		format = formatJSON
+	}
+
+	b, err := marshal(format, data, indent)
+	if err != nil {
+		b, _ = marshal(formatJSON, []string{fmt.Sprintf("can't write response as %s: %s", format, err.Error())}, indent)
+		format = formatJSON
+		code = http.StatusNotAcceptable
 	}
+
+	w.Header().Set("Content-Type", contentTypes[format])
+	varyAccept(w)
+	w.WriteHeader(code)
 	w.Write(b)
 }